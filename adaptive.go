@@ -0,0 +1,53 @@
+package main
+
+import (
+	"fmt"
+	"time"
+)
+
+// maxArrivals bounds the arrival times kept per chat. Chats faster than
+// that over the adaptive window look slower than they are, which the
+// probability caps absorb.
+const maxArrivals = 1000
+
+// messageRate returns messages per hour among arrivals over window.
+func messageRate(arrivals []time.Time, now time.Time, window time.Duration) float64 {
+	if window <= 0 {
+		return 0
+	}
+	var n int
+	for _, t := range arrivals {
+		if now.Sub(t) <= window {
+			n++
+		}
+	}
+	return float64(n) / window.Hours()
+}
+
+// adaptiveProbability picks the trigger probability that gives about
+// AdaptiveRepliesPerHour unsolicited replies at the chat's message rate,
+// within the configured caps.
+func adaptiveProbability(config *Config, rate float64) float64 {
+	if rate <= 0 {
+		return config.AdaptiveMaxProbability
+	}
+	p := config.AdaptiveRepliesPerHour / rate
+	return min(max(p, config.AdaptiveMinProbability), config.AdaptiveMaxProbability)
+}
+
+func validateAdaptive(config *Config) error {
+	if config.AdaptiveRepliesPerHour < 0 {
+		return fmt.Errorf("adaptive_replies_per_hour must not be negative")
+	}
+	if config.AdaptiveRepliesPerHour == 0 {
+		return nil
+	}
+	if config.AdaptiveWindow <= 0 {
+		return fmt.Errorf("adaptive_window must be positive")
+	}
+	lo, hi := config.AdaptiveMinProbability, config.AdaptiveMaxProbability
+	if lo < 0 || hi > 1 || lo > hi {
+		return fmt.Errorf("adaptive probability caps must satisfy 0 <= adaptive_min_probability <= adaptive_max_probability <= 1")
+	}
+	return nil
+}
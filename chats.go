@@ -0,0 +1,168 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"slices"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+)
+
+// chatConfig is a chat on the allowlist. Overrides left empty fall back to
+// the global settings.
+type chatConfig struct {
+	ID int64 `mapstructure:"id"`
+	// Personas limits the persona of the day, /persona and keyword personas
+	// to these IDs.
+	Personas []string `mapstructure:"personas"`
+	// Probability replaces trigger_probability and adaptive replies.
+	Probability *float64 `mapstructure:"probability"`
+	Language    string   `mapstructure:"language"`
+}
+
+// validateChats adds the single chat_id of older configs to the allowlist
+// and checks the per-chat overrides.
+func validateChats(config *Config) error {
+	if config.ChatID != 0 {
+		if _, ok := config.chat(config.ChatID); !ok {
+			config.Chats = append(config.Chats, chatConfig{ID: config.ChatID})
+		}
+	}
+	seen := make(map[int64]bool)
+	for _, c := range config.Chats {
+		switch {
+		case c.ID == 0:
+			return fmt.Errorf("chats: id is required")
+		case seen[c.ID]:
+			return fmt.Errorf("chats: chat %d is listed twice", c.ID)
+		case c.Probability != nil && (*c.Probability < 0 || *c.Probability > 1):
+			return fmt.Errorf("chats: probability of chat %d must be between 0 and 1", c.ID)
+		}
+		seen[c.ID] = true
+		for _, id := range c.Personas {
+			if _, ok := config.Personas.get(id); !ok {
+				return fmt.Errorf("chats: unknown persona %q for chat %d", id, c.ID)
+			}
+		}
+	}
+	return nil
+}
+
+// chat returns the allowlist entry for chatID.
+func (c *Config) chat(chatID int64) (chatConfig, bool) {
+	i := slices.IndexFunc(c.Chats, func(chat chatConfig) bool { return chat.ID == chatID })
+	if i == -1 {
+		return chatConfig{}, false
+	}
+	return c.Chats[i], true
+}
+
+// forChat returns the config with the overrides of chatID applied.
+func (c *Config) forChat(chatID int64) *Config {
+	chat, ok := c.chat(chatID)
+	if !ok {
+		return c
+	}
+	config := *c
+	if chat.Probability != nil {
+		config.TriggerProbability = *chat.Probability
+		config.AdaptiveRepliesPerHour = 0
+	}
+	if len(chat.Personas) > 0 {
+		config.Personas = c.Personas.subset(chat.Personas)
+	}
+	if chat.Language != "" {
+		config.Language = chat.Language
+	}
+	return &config
+}
+
+// config returns the config as seen from chatID and whether the bot may
+// talk there. Without an allowlist every chat is allowed. A supergroup
+// migrated from an allowed group counts as that group.
+func (p *pipeline) config(chatID int64) (*Config, bool) {
+	config := p.configs.get()
+	if len(config.Chats) == 0 {
+		return config, true
+	}
+	if _, ok := config.chat(chatID); ok {
+		return config.forChat(chatID), true
+	}
+	if from := p.chats.migratedFrom(chatID); from != 0 {
+		if _, ok := config.chat(from); ok {
+			return config.forChat(from), true
+		}
+	}
+	return config, false
+}
+
+// membership handles a change of the bot's own membership: it leaves
+// groups it was added to that are not on the allowlist.
+func (p *pipeline) membership(update *tgbotapi.ChatMemberUpdated) {
+	chat := update.Chat
+	if chat.IsPrivate() {
+		return
+	}
+	switch update.NewChatMember.Status {
+	case "left", "kicked":
+		log.Printf("Removed from chat %d (%s)", chat.ID, chat.Title)
+		p.leaving.Delete(chat.ID)
+		return
+	}
+	if _, ok := p.config(chat.ID); ok {
+		log.Printf("Added to chat %d (%s)", chat.ID, chat.Title)
+		return
+	}
+	p.leave(&chat, &update.From)
+}
+
+// leave leaves an unauthorized chat and tells the owner who added the bot
+// there, when that is known.
+func (p *pipeline) leave(chat *tgbotapi.Chat, by *tgbotapi.User) {
+	if _, leaving := p.leaving.LoadOrStore(chat.ID, true); leaving {
+		return
+	}
+	log.Printf("Leaving unauthorized chat %d (%s)", chat.ID, chat.Title)
+	if _, err := p.bot.Request(tgbotapi.LeaveChatConfig{ChatID: chat.ID}); err != nil {
+		log.Printf("Error leaving chat %d: %v", chat.ID, err)
+		metricSendErrors.inc("leaveChat")
+	}
+
+	text := fmt.Sprintf("Покинул чат «%s» (%d), его нет в списке chats.", chat.Title, chat.ID)
+	if by != nil && by.ID != 0 {
+		text += " Добавил: " + userLabel(by) + "."
+	}
+	p.notifyOwner(text)
+}
+
+// migrate moves the settings of a group that became a supergroup to its
+// new ID. Telegram reports a migration in both chats, the second report is
+// ignored.
+func (p *pipeline) migrate(from, to int64) {
+	if !p.chats.migrate(from, to) {
+		return
+	}
+	log.Printf("Chat %d migrated to %d", from, to)
+	if _, ok := p.configs.get().chat(from); ok {
+		p.notifyOwner(fmt.Sprintf("Группа %d стала супергруппой %d, замените id в списке chats.", from, to))
+	}
+}
+
+// notifyOwner sends text to owner_id in private, if it is set.
+func (p *pipeline) notifyOwner(text string) {
+	owner := p.configs.get().OwnerID
+	if owner == 0 {
+		return
+	}
+	if _, err := p.bot.Send(tgbotapi.NewMessage(owner, text)); err != nil {
+		log.Printf("Error notifying owner: %v", err)
+		metricSendErrors.inc("sendMessage")
+	}
+}
+
+func userLabel(u *tgbotapi.User) string {
+	if u.UserName != "" {
+		return "@" + u.UserName
+	}
+	return fmt.Sprintf("%s (%d)", u.FirstName, u.ID)
+}
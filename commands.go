@@ -0,0 +1,274 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"math/rand"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+)
+
+// commandEnv is what a command needs to inspect and change a chat.
+type commandEnv struct {
+	bot    Sender
+	config *Config
+	chats  *chatStates
+	key    chatKey
+	now    time.Time
+}
+
+type commandFunc func(env *commandEnv, args []string) string
+
+var commands = map[string]commandFunc{
+	"prob":    cmdProb,
+	"mute":    cmdMute,
+	"unmute":  cmdUnmute,
+	"quiet":   cmdQuiet,
+	"topic":   cmdTopic,
+	"persona": cmdPersona,
+	"status":  cmdStatus,
+	"usage":   cmdUsage,
+}
+
+// isBotCommand reports whether message is one of our commands. Commands
+// addressed to another bot with /cmd@otherbot are ignored.
+func isBotCommand(bot Sender, message *tgbotapi.Message) bool {
+	if _, ok := commands[message.Command()]; !ok {
+		return false
+	}
+	withAt := message.CommandWithAt()
+	if i := strings.Index(withAt, "@"); i != -1 {
+		return strings.EqualFold(withAt[i+1:], bot.Me().UserName)
+	}
+	return true
+}
+
+// handleCommand runs a command from an admin and answers with its result.
+func handleCommand(env *commandEnv, message *tgbotapi.Message) {
+	if message.From == nil || !isAdmin(env.bot, env.config, message.Chat.ID, message.From.ID) {
+		log.Printf("Command /%s from non-admin in chat %d", message.Command(), message.Chat.ID)
+		sendMessage(env.bot, env.key, "Только для командования.", message.MessageID, env.now)
+		return
+	}
+
+	run := commands[message.Command()]
+	result := run(env, strings.Fields(message.CommandArguments()))
+	log.Printf("Command /%s %s in chat %d by %d", message.Command(), message.CommandArguments(), message.Chat.ID, message.From.ID)
+	sendMessage(env.bot, env.key, result, message.MessageID, env.now)
+}
+
+// isAdmin reports whether userID is on the admin list or administers the chat.
+func isAdmin(bot Sender, config *Config, chatID, userID int64) bool {
+	if slices.Contains(config.AdminIDs, userID) {
+		return true
+	}
+
+	admins, err := bot.GetChatAdministrators(tgbotapi.ChatAdministratorsConfig{
+		ChatConfig: tgbotapi.ChatConfig{ChatID: chatID},
+	})
+	if err != nil {
+		log.Printf("Error getting chat administrators: %v", err)
+		return false
+	}
+	for _, a := range admins {
+		if a.User != nil && a.User.ID == userID {
+			return true
+		}
+	}
+	return false
+}
+
+func (env *commandEnv) activity() chatActivity {
+	return env.chats.activity(env.key, env.now, env.config.AdaptiveWindow)
+}
+
+func cmdProb(env *commandEnv, args []string) string {
+	if len(args) != 1 {
+		return fmt.Sprintf("Вероятность ответа: %.2f. Использование: /prob 0.2 или /prob auto",
+			env.chats.settings(env.key).probability(env.config, env.activity()))
+	}
+	if args[0] == "auto" {
+		env.chats.updateSettings(env.key.chat(), func(s *chatSettings) {
+			s.Probability = nil
+		})
+		return fmt.Sprintf("Вероятность ответа по настройкам: %.2f",
+			env.chats.settings(env.key).probability(env.config, env.activity()))
+	}
+	p, err := strconv.ParseFloat(strings.Replace(args[0], ",", ".", 1), 64)
+	if err != nil || p < 0 || p > 1 {
+		return "Вероятность должна быть числом от 0 до 1."
+	}
+	env.chats.updateSettings(env.key.chat(), func(s *chatSettings) {
+		s.Probability = &p
+	})
+	return fmt.Sprintf("Вероятность ответа: %.2f", p)
+}
+
+func cmdMute(env *commandEnv, args []string) string {
+	if len(args) != 1 {
+		return "Использование: /mute 2h"
+	}
+	d, err := time.ParseDuration(args[0])
+	if err != nil || d <= 0 {
+		return "Длительность в формате 30m, 2h, 1h30m."
+	}
+	until := env.now.Add(d)
+	env.chats.updateSettings(env.key.chat(), func(s *chatSettings) {
+		s.MutedUntil = until
+	})
+	return fmt.Sprintf("Молчу до %s UTC.", until.UTC().Format("2006-01-02 15:04"))
+}
+
+func cmdUnmute(env *commandEnv, args []string) string {
+	env.chats.updateSettings(env.key.chat(), func(s *chatSettings) {
+		s.MutedUntil = time.Time{}
+	})
+	return "Снова на связи."
+}
+
+func cmdTopic(env *commandEnv, args []string) string {
+	if env.key.ThreadID == 0 {
+		return "Команда работает только в темах форума."
+	}
+	if len(args) != 1 || args[0] != "on" && args[0] != "off" {
+		return "Использование: /topic on или /topic off"
+	}
+	off := args[0] == "off"
+	env.chats.updateSettings(env.key, func(s *chatSettings) {
+		s.TopicOff = off
+	})
+	if off {
+		return "В этой теме молчу, /topic on вернёт."
+	}
+	return "В этой теме снова на связи."
+}
+
+func cmdQuiet(env *commandEnv, args []string) string {
+	const usage = "Использование: /quiet 23:00-08:00 [Europe/Moscow] или /quiet off"
+	if len(args) == 0 || len(args) > 2 {
+		quiet, loc := env.chats.settings(env.key).quietHours(env.config)
+		return fmt.Sprintf("Тихие часы: %s (%s). %s", quiet, loc, usage)
+	}
+	if _, err := parseQuietHours(args[0]); err != nil {
+		return usage
+	}
+	var tz string
+	if len(args) == 2 {
+		if _, err := time.LoadLocation(args[1]); err != nil {
+			return fmt.Sprintf("Неизвестный часовой пояс %q.", args[1])
+		}
+		tz = args[1]
+	}
+	env.chats.updateSettings(env.key.chat(), func(s *chatSettings) {
+		s.QuietHours = args[0]
+		if tz != "" {
+			s.TimeZone = tz
+		}
+	})
+	quiet, loc := env.chats.settings(env.key).quietHours(env.config)
+	return fmt.Sprintf("Тихие часы: %s (%s).", quiet, loc)
+}
+
+func cmdPersona(env *commandEnv, args []string) string {
+	personas := env.config.Personas
+	if len(args) == 0 {
+		return "Использование: /persona list|set ID|random"
+	}
+
+	switch args[0] {
+	case "list":
+		current := env.chats.persona(env.key, env.now, personas)
+		var b strings.Builder
+		for _, p := range personas.personas {
+			mark := " "
+			if p == current {
+				mark = "*"
+			}
+			fmt.Fprintf(&b, "%s%s — %s\n", mark, p.ID, p.Name)
+		}
+		return b.String()
+	case "set":
+		if len(args) != 2 {
+			return "Использование: /persona set ID"
+		}
+		p, ok := personas.get(args[1])
+		if !ok {
+			return fmt.Sprintf("Нет персоны %q, см. /persona list", args[1])
+		}
+		env.chats.updateSettings(env.key.chat(), func(s *chatSettings) {
+			s.Persona = p.ID
+			s.PersonaLocked = true
+		})
+		return "Персона: " + p.Name
+	case "random":
+		p := personas.pick(rand.New(rand.NewSource(env.now.UnixNano())))
+		env.chats.updateSettings(env.key.chat(), func(s *chatSettings) {
+			s.Persona = p.ID
+			s.PersonaDay = env.now.UTC().Truncate(time.Hour * 24)
+			s.PersonaLocked = false
+		})
+		return "Персона: " + p.Name
+	default:
+		return "Использование: /persona list|set ID|random"
+	}
+}
+
+func cmdStatus(env *commandEnv, args []string) string {
+	persona := env.chats.persona(env.key, env.now, env.config.Personas)
+	state := env.chats.snapshot(env.key)
+	s := env.chats.settings(env.key)
+
+	var b strings.Builder
+	fmt.Fprintf(&b, "Персона: %s (%s)", persona.Name, persona.ID)
+	if s.PersonaLocked {
+		b.WriteString(", закреплена")
+	}
+	activity := env.activity()
+	fmt.Fprintf(&b, "\nВероятность ответа: %.2f", s.probability(env.config, activity))
+	if s.Probability == nil && env.config.AdaptiveRepliesPerHour > 0 {
+		fmt.Fprintf(&b, " (адаптивная, %.0f сообщений в час)", activity.Rate)
+	}
+	if s.TopicOff {
+		b.WriteString("\nВ этой теме выключен")
+	}
+	if s.muted(env.now) {
+		fmt.Fprintf(&b, "\nМолчу до %s UTC", s.MutedUntil.UTC().Format("2006-01-02 15:04"))
+	}
+	if quiet, loc := s.quietHours(env.config); quiet.from != quiet.to {
+		fmt.Fprintf(&b, "\nТихие часы: %s (%s)", quiet, loc)
+	}
+	fmt.Fprintf(&b, "\nСообщений в истории: %d, ответов: %d", len(state.History), len(state.Replies))
+	return b.String()
+}
+
+func cmdUsage(env *commandEnv, args []string) string {
+	day, month := env.chats.usage(env.key.ChatID, env.now)
+	globalDay, globalMonth := env.chats.globalUsage(env.now)
+	c := env.config
+
+	var b strings.Builder
+	fmt.Fprintf(&b, "Этот чат сегодня: %s\n", formatUsage(day, 0))
+	fmt.Fprintf(&b, "Этот чат за месяц: %s\n", formatUsage(month, 0))
+	fmt.Fprintf(&b, "Всего сегодня: %s\n", formatUsage(globalDay, c.HardDailyTokens))
+	fmt.Fprintf(&b, "Всего за месяц: %s", formatUsage(globalMonth, c.HardMonthlyTokens))
+	switch c.budgetLevel(globalDay, globalMonth) {
+	case budgetSoft:
+		b.WriteString("\nБюджет исчерпан, отвечаю только на упоминания.")
+	case budgetHard:
+		b.WriteString("\nБюджет исчерпан, связь с варпом потеряна.")
+	}
+	return b.String()
+}
+
+// shorten cuts s to at most n runes.
+func shorten(s string, n int) string {
+	r := []rune(strings.TrimSpace(s))
+	if len(r) <= n {
+		return string(r)
+	}
+	return string(r[:n]) + "…"
+}
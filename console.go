@@ -0,0 +1,204 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"slices"
+	"strings"
+	"time"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+	"github.com/spf13/pflag"
+	"github.com/spf13/viper"
+)
+
+// The console plays a single group chat with a made-up bot account. The chat
+// takes the ID of the first allowed chat when there is an allowlist.
+const (
+	consoleChatID = -1
+	consoleBotID  = 1
+)
+
+// runConsole runs the reply pipeline against stdin and stdout instead of
+// Telegram, for trying out personas and prompts.
+func runConsole(args []string) {
+	flags := pflag.NewFlagSet("console", pflag.ExitOnError)
+	configFile := flags.String("config", "", "config file, config.yaml in the working directory by default")
+	users := flags.StringSlice("users", []string{"user"},
+		`simulated user names, start a line with "name:" to write as one of them`)
+	personaID := flags.String("persona", "", "always answer as this persona")
+	providerName := flags.String("provider", "", "override the configured provider, echo works offline")
+	printRequest := flags.Bool("print-request", false, "print the request payload sent to the provider")
+	always := flags.Bool("always", false, "set the trigger probability to 1")
+	botName := flags.String("bot", "warbot", "user name of the simulated bot")
+	verbose := flags.Bool("verbose", false, "show the log")
+	flags.Usage = func() {
+		fmt.Fprintln(os.Stderr, "Usage: barrens-warhammer console [flags]")
+		fmt.Fprintln(os.Stderr, `Lines starting with "> " reply to the bot's last message.`)
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+
+	if !*verbose {
+		log.SetOutput(io.Discard)
+	}
+	config, provider := offlineConfig(*configFile, *providerName)
+	var forced *Persona
+	if *personaID != "" {
+		p, ok := config.Personas.get(*personaID)
+		if !ok {
+			fatalf("Unknown persona %q", *personaID)
+		}
+		forced = p
+	}
+	if *printRequest {
+		provider = &printingProvider{Provider: provider}
+	}
+
+	chats, err := newChatStates(memoryStore{}, retentionPolicy{
+		MaxMessages: config.StoreUpdates,
+		MaxAge:      config.HistoryMaxAge,
+	})
+	if err != nil {
+		fatalf("%v", err)
+	}
+	c := &console{
+		users:  *users,
+		self:   tgbotapi.User{ID: consoleBotID, IsBot: true, UserName: *botName},
+		chatID: consoleChatID,
+	}
+	if len(config.Chats) > 0 {
+		c.chatID = config.Chats[0].ID
+	}
+	if *always {
+		chats.updateSettings(c.key(), func(s *chatSettings) {
+			one := 1.0
+			s.Probability = &one
+		})
+	}
+
+	p := &pipeline{
+		bot: &offlineSender{self: c.self, clock: systemClock{}, sent: func(_ int64, id int, text string) {
+			c.lastReply = id
+			fmt.Printf("%s: %s\n", c.self.UserName, text)
+		}},
+		configs:  newConfigHolder(config),
+		provider: provider,
+		chats:    chats,
+		clock:    systemClock{},
+		rand:     globalRandom{},
+		persona:  forced,
+		decided: func(_ *tgbotapi.Message, _, detail string) {
+			if detail != "" {
+				fmt.Printf("-- %s\n", detail)
+			}
+		},
+	}
+	p.submit = p.handle
+
+	fmt.Printf("Chat as %s, the bot is @%s. Ctrl-D to quit.\n", strings.Join(c.users, ", "), *botName)
+	scanner := bufio.NewScanner(os.Stdin)
+	for scanner.Scan() {
+		if line := strings.TrimSpace(scanner.Text()); line != "" {
+			p.receive(incomingUpdate{Update: tgbotapi.Update{Message: c.message(line)}})
+		}
+	}
+}
+
+// offlineConfig loads the config for the console and replays. Replies are
+// not streamed, there is nothing to edit offline.
+func offlineConfig(file, providerName string) (*Config, Provider) {
+	if err := setupConfig(file); err != nil {
+		fatalf("Failed to read config: %v", err)
+	}
+	if providerName != "" {
+		viper.Set("provider", providerName)
+	}
+	config, err := decodeConfig()
+	if err != nil {
+		fatalf("Failed to load config: %v", err)
+	}
+	config.StreamReplies = false
+
+	provider, err := newProvider(config)
+	if err != nil {
+		fatalf("Failed to create provider: %v", err)
+	}
+	return config, provider
+}
+
+// fatalf reports an error of an offline command, whose log may be silenced.
+func fatalf(format string, args ...any) {
+	fmt.Fprintf(os.Stderr, format+"\n", args...)
+	os.Exit(1)
+}
+
+type console struct {
+	users  []string
+	self   tgbotapi.User
+	chatID int64
+
+	lastID    int
+	lastReply int
+}
+
+func (c *console) key() chatKey {
+	return chatKey{ChatID: c.chatID}
+}
+
+// message turns a line of input into a Telegram message. "name: text"
+// writes as one of the simulated users, "> text" replies to the bot.
+func (c *console) message(line string) *tgbotapi.Message {
+	c.lastID += 2
+	message := &tgbotapi.Message{
+		MessageID: c.lastID,
+		Chat:      &tgbotapi.Chat{ID: c.chatID, Type: "supergroup"},
+		Date:      int(time.Now().Unix()),
+	}
+
+	user := 0
+	if name, text, ok := strings.Cut(line, ":"); ok {
+		if i := slices.Index(c.users, strings.TrimSpace(name)); i != -1 {
+			user, line = i, strings.TrimSpace(text)
+		}
+	}
+	message.From = &tgbotapi.User{ID: int64(100 + user), UserName: c.users[user]}
+
+	if text, ok := strings.CutPrefix(line, "> "); ok && c.lastReply != 0 {
+		line = text
+		message.ReplyToMessage = &tgbotapi.Message{
+			MessageID: c.lastReply,
+			From:      &c.self,
+			Chat:      message.Chat,
+		}
+	}
+	message.Text = line
+	return message
+}
+
+// printingProvider prints the body of every request before sending it.
+type printingProvider struct {
+	Provider
+}
+
+func (p *printingProvider) Generate(ctx context.Context, req completionRequest) (completionResponse, error) {
+	data, _ := json.MarshalIndent(requestPayload(p.Provider, req), "", "  ")
+	fmt.Println(string(data))
+	return p.Provider.Generate(ctx, req)
+}
+
+// requestPayload returns the body the provider would send for req.
+func requestPayload(provider Provider, req completionRequest) any {
+	switch p := provider.(type) {
+	case *openAIProvider:
+		return p.request(req)
+	case *anthropicProvider:
+		return p.request(req)
+	}
+	return req
+}
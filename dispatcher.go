@@ -0,0 +1,119 @@
+package main
+
+import (
+	"context"
+	"log"
+	"sync"
+)
+
+// job is a triggered message waiting for a reply.
+type job struct {
+	key    chatKey
+	update incomingUpdate
+	reason string
+}
+
+// priority jobs are never dropped in favour of unsolicited replies. Voice
+// messages are kept too, dropping them would lose them from the history.
+func (j job) priority() bool {
+	return j.reason == triggerMention || j.reason == triggerReply || j.reason == triggerCommand ||
+		j.reason == triggerVoice
+}
+
+// dispatcher runs one worker per chat so a slow reply in one chat does not
+// hold up the others, while replies within a chat stay in order.
+type dispatcher struct {
+	mu        sync.Mutex
+	queues    map[chatKey][]job
+	queueSize int
+	handle    func(job)
+	workers   sync.WaitGroup
+}
+
+func newDispatcher(queueSize int, handle func(job)) *dispatcher {
+	return &dispatcher{
+		queues:    make(map[chatKey][]job),
+		queueSize: queueSize,
+		handle:    handle,
+	}
+}
+
+// submit queues j for its chat, starting the chat's worker if it is idle.
+// A full queue drops its oldest unsolicited reply first.
+func (d *dispatcher) submit(j job) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	queue, running := d.queues[j.key]
+	if len(queue) >= d.queueSize {
+		drop := -1
+		for i, q := range queue {
+			if !q.priority() {
+				drop = i
+				break
+			}
+		}
+		if drop == -1 {
+			if !j.priority() {
+				log.Printf("Queue for chat %d is full, dropping %s trigger", j.key.ChatID, j.reason)
+				return
+			}
+			drop = 0
+		}
+		log.Printf("Queue for chat %d is full, dropping %s trigger for message %d",
+			j.key.ChatID, queue[drop].reason, queue[drop].update.Message.MessageID)
+		queue = append(queue[:drop], queue[drop+1:]...)
+	}
+	d.queues[j.key] = append(queue, j)
+
+	if !running {
+		d.workers.Add(1)
+		go func() {
+			defer d.workers.Done()
+			d.work(j.key)
+		}()
+	}
+}
+
+// wait blocks until every queued job has been handled. Nothing may be
+// submitted meanwhile.
+func (d *dispatcher) wait() {
+	d.workers.Wait()
+}
+
+func (d *dispatcher) work(key chatKey) {
+	for {
+		d.mu.Lock()
+		queue := d.queues[key]
+		if len(queue) == 0 {
+			delete(d.queues, key)
+			d.mu.Unlock()
+			return
+		}
+		j := queue[0]
+		d.queues[key] = queue[1:]
+		d.mu.Unlock()
+
+		d.handle(j)
+	}
+}
+
+// limitedProvider caps the number of concurrent calls to a provider.
+type limitedProvider struct {
+	Provider
+	slots chan struct{}
+}
+
+func newLimitedProvider(p Provider, n int) *limitedProvider {
+	return &limitedProvider{Provider: p, slots: make(chan struct{}, n)}
+}
+
+func (p *limitedProvider) Generate(ctx context.Context, req completionRequest) (completionResponse, error) {
+	select {
+	case p.slots <- struct{}{}:
+	case <-ctx.Done():
+		return completionResponse{}, ctx.Err()
+	}
+	defer func() { <-p.slots }()
+	return p.Provider.Generate(ctx, req)
+}
@@ -0,0 +1,536 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+)
+
+// e2eScenario runs the whole bot against a fake Bot API server.
+type e2eScenario struct {
+	name string
+	// setup adjusts the config before the bot starts.
+	setup func(config *Config)
+	run   func(e *e2eEnv) error
+}
+
+// e2eEnv is a running bot with the fake server it talks to.
+type e2eEnv struct {
+	fake   *fakeTelegram
+	config *Config
+	// chat is the first allowed chat.
+	chat     int64
+	requests *recordingProvider
+	timeout  time.Duration
+}
+
+var e2eScenarios = []e2eScenario{
+	{name: "mention", run: e2eMention},
+	{name: "reply chain", run: e2eReplyChain},
+	{name: "unauthorized chat", run: e2eUnauthorized},
+	{name: "added to a group", run: e2eAdded},
+	{name: "migration", run: e2eMigration},
+	{name: "chat overrides", run: e2eOverrides},
+	{name: "forum topics", run: e2eTopics},
+	{name: "topic root", run: e2eTopicRoot},
+	{name: "document", run: e2eDocument},
+	{name: "streaming", setup: func(c *Config) {
+		c.StreamReplies = true
+		c.StreamEditInterval = 0
+	}, run: e2eStreaming},
+}
+
+// e2eTimeout is how long a scenario waits for each expected call.
+const e2eTimeout = 5 * time.Second
+
+// TestE2E starts the bot against a fake Bot API server for every scenario
+// and checks the calls it makes.
+func TestE2E(t *testing.T) {
+	if !testing.Verbose() {
+		log.SetOutput(io.Discard)
+		defer log.SetOutput(os.Stderr)
+	}
+	if err := setupConfig("testdata/e2e/config.yaml"); err != nil {
+		t.Fatal(err)
+	}
+	base, err := decodeConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, s := range e2eScenarios {
+		t.Run(s.name, func(t *testing.T) {
+			config := *base
+			if s.setup != nil {
+				s.setup(&config)
+			}
+			if err := runScenario(s, &config); err != nil {
+				t.Fatal(err)
+			}
+		})
+	}
+}
+
+// runScenario wires the bot the way main does, with the fake server as
+// telegram_api_url and an in-memory store. The poller and the workers are
+// stopped before it returns.
+func runScenario(s e2eScenario, config *Config) error {
+	fake := newFakeTelegram(config.TelegramToken, tgbotapi.User{ID: consoleBotID, IsBot: true, FirstName: "Warbot", UserName: "warbot"})
+	defer fake.Close()
+	config.TelegramAPIURL = fake.URL()
+
+	bot, err := newBotAPI(config)
+	if err != nil {
+		return err
+	}
+	provider, err := newProvider(config)
+	if err != nil {
+		return err
+	}
+	chats, err := newChatStates(memoryStore{}, retentionPolicy{
+		MaxMessages: config.StoreUpdates,
+		MaxAge:      config.HistoryMaxAge,
+	})
+	if err != nil {
+		return err
+	}
+	requests := &recordingProvider{Provider: provider}
+	p := newPipeline(newBotSender(bot, config), newConfigHolder(config), requests, chats)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	updates, err := receiveUpdates(ctx, bot, config)
+	if err != nil {
+		return err
+	}
+	done := make(chan struct{})
+	go func() {
+		p.run(updates)
+		close(done)
+	}()
+	defer func() {
+		cancel()
+		fake.endPolling()
+		<-done
+	}()
+
+	return s.run(&e2eEnv{fake: fake, config: config, chat: config.Chats[0].ID, requests: requests, timeout: e2eTimeout})
+}
+
+// message is a text message from a user of chat. It gets its ID when it
+// is pushed.
+func (e *e2eEnv) message(chatID int64, text string) *tgbotapi.Message {
+	return &tgbotapi.Message{
+		From: &tgbotapi.User{ID: 100, FirstName: "Вася", UserName: "vasya"},
+		Chat: &tgbotapi.Chat{ID: chatID, Type: "supergroup"},
+		Date: int(time.Now().Unix()),
+		Text: text,
+	}
+}
+
+// push sends message to the bot and returns its ID.
+func (e *e2eEnv) push(message *tgbotapi.Message) string {
+	return strconv.Itoa(e.fake.push(incomingUpdate{Update: tgbotapi.Update{Message: message}}))
+}
+
+// pushToTopic sends message to the bot from forum topic thread. Like
+// Telegram, it makes a message that is no reply answer the service message
+// that created the topic, here created by the bot.
+func (e *e2eEnv) pushToTopic(message *tgbotapi.Message, thread int) string {
+	if message.ReplyToMessage == nil {
+		message.ReplyToMessage = &tgbotapi.Message{
+			MessageID: thread,
+			From:      &e.fake.self,
+			Chat:      message.Chat,
+			Date:      message.Date,
+		}
+	}
+	update := incomingUpdate{
+		Update: tgbotapi.Update{Message: message},
+		Topic:  topicInfo{MessageThreadID: thread, IsTopicMessage: true},
+	}
+	return strconv.Itoa(e.fake.push(update))
+}
+
+// replies waits for n sendMessage calls.
+func (e *e2eEnv) replies(n int) ([]fakeCall, error) {
+	return e.fake.waitCalls("sendMessage", n, e.timeout)
+}
+
+// lastPrompt returns the conversation of the latest request to the provider.
+func (e *e2eEnv) lastPrompt() ([]promptMessage, error) {
+	requests := e.requests.take()
+	if len(requests) == 0 {
+		return nil, fmt.Errorf("no request reached the provider")
+	}
+	return requests[len(requests)-1].Messages, nil
+}
+
+func checkParam(call fakeCall, name, want string) error {
+	if got := call.Params.Get(name); got != want {
+		return fmt.Errorf("%s %s = %q, want %q", call.Method, name, got, want)
+	}
+	return nil
+}
+
+func hasTurn(messages []promptMessage, role, content string) bool {
+	return slices.ContainsFunc(messages, func(m promptMessage) bool {
+		return m.Role == role && strings.Contains(m.Content, content)
+	})
+}
+
+func chatIDParam(id int64) string {
+	return strconv.FormatInt(id, 10)
+}
+
+// e2eMention checks that a mention is answered in reply to it, with the
+// typing indicator shown first.
+func e2eMention(e *e2eEnv) error {
+	id := e.push(e.message(e.chat, "@warbot как там Империум?"))
+	calls, err := e.replies(1)
+	if err != nil {
+		return err
+	}
+	for _, check := range []error{
+		checkParam(calls[0], "chat_id", chatIDParam(e.chat)),
+		checkParam(calls[0], "reply_to_message_id", id),
+		checkParam(calls[0], "text", e.config.CannedResponses[0]),
+		checkParam(calls[0], "message_thread_id", ""),
+	} {
+		if check != nil {
+			return check
+		}
+	}
+	actions := e.fake.callsTo("sendChatAction")
+	if len(actions) == 0 {
+		return fmt.Errorf("no typing indicator")
+	}
+	return checkParam(actions[0], "action", tgbotapi.ChatTyping)
+}
+
+// e2eReplyChain checks that a reply to the bot is answered with the bot's
+// earlier message in the prompt.
+func e2eReplyChain(e *e2eEnv) error {
+	e.push(e.message(e.chat, "@warbot кто сильнее, орки или тираниды?"))
+	calls, err := e.replies(1)
+	if err != nil {
+		return err
+	}
+	e.requests.take()
+
+	reply := e.message(e.chat, "А почему так думаешь?")
+	reply.ReplyToMessage = &tgbotapi.Message{
+		MessageID: calls[0].MessageID,
+		From:      &e.fake.self,
+		Chat:      reply.Chat,
+		Text:      calls[0].Params.Get("text"),
+	}
+	id := e.push(reply)
+	calls, err = e.replies(2)
+	if err != nil {
+		return err
+	}
+	if err := checkParam(calls[1], "reply_to_message_id", id); err != nil {
+		return err
+	}
+
+	prompt, err := e.lastPrompt()
+	if err != nil {
+		return err
+	}
+	if !hasTurn(prompt, "user", "кто сильнее, орки или тираниды?") ||
+		!hasTurn(prompt, "assistant", calls[0].Params.Get("text")) {
+		return fmt.Errorf("reply chain missing from the prompt: %+v", prompt)
+	}
+	return nil
+}
+
+// e2eUnauthorized checks that mentions in other groups are ignored and the
+// bot leaves them.
+func e2eUnauthorized(e *e2eEnv) error {
+	stranger := e.chat - 100
+	e.push(e.message(stranger, "@warbot ответь и нам"))
+	// The allowed chat's reply marks the point where the stranger's message
+	// has been handled too.
+	e.push(e.message(e.chat, "@warbot а нам?"))
+	if _, err := e.replies(2); err != nil {
+		return err
+	}
+
+	leaves := e.fake.callsTo("leaveChat")
+	if len(leaves) != 1 {
+		return fmt.Errorf("leaveChat called %d times, want 1", len(leaves))
+	}
+	if err := checkParam(leaves[0], "chat_id", chatIDParam(stranger)); err != nil {
+		return err
+	}
+	for _, call := range e.fake.callsTo("sendChatAction") {
+		if err := checkParam(call, "chat_id", chatIDParam(e.chat)); err != nil {
+			return err
+		}
+	}
+	return e.checkRecipients(e.chat, e.config.OwnerID)
+}
+
+// e2eAdded checks that the bot stays in allowed groups it is added to and
+// leaves the others, telling the owner who added it.
+func e2eAdded(e *e2eEnv) error {
+	stranger := e.chat - 100
+	e.fake.push(incomingUpdate{Update: tgbotapi.Update{MyChatMember: e.added(e.chat)}})
+	e.fake.push(incomingUpdate{Update: tgbotapi.Update{MyChatMember: e.added(stranger)}})
+	if _, err := e.fake.waitCalls("leaveChat", 1, e.timeout); err != nil {
+		return err
+	}
+	notices, err := e.replies(1)
+	if err != nil {
+		return err
+	}
+
+	leaves := e.fake.callsTo("leaveChat")
+	if len(leaves) != 1 {
+		return fmt.Errorf("leaveChat called %d times, want 1", len(leaves))
+	}
+	if err := checkParam(leaves[0], "chat_id", chatIDParam(stranger)); err != nil {
+		return err
+	}
+	if err := checkParam(notices[0], "chat_id", chatIDParam(e.config.OwnerID)); err != nil {
+		return err
+	}
+	if text := notices[0].Params.Get("text"); !strings.Contains(text, "@vasya") {
+		return fmt.Errorf("owner notice does not name who added the bot: %q", text)
+	}
+	return nil
+}
+
+// added is the update telling the bot vasya added it to chat.
+func (e *e2eEnv) added(chatID int64) *tgbotapi.ChatMemberUpdated {
+	return &tgbotapi.ChatMemberUpdated{
+		Chat:          tgbotapi.Chat{ID: chatID, Type: "supergroup", Title: "Чат " + chatIDParam(chatID)},
+		From:          tgbotapi.User{ID: 100, FirstName: "Вася", UserName: "vasya"},
+		Date:          int(time.Now().Unix()),
+		OldChatMember: tgbotapi.ChatMember{User: &e.fake.self, Status: "left"},
+		NewChatMember: tgbotapi.ChatMember{User: &e.fake.self, Status: "member"},
+	}
+}
+
+// e2eMigration checks that a group upgraded to a supergroup stays allowed
+// under its new ID and that the owner hears about it once.
+func e2eMigration(e *e2eEnv) error {
+	supergroup := e.chat - 100
+	migrated := e.message(e.chat, "")
+	migrated.MigrateToChatID = supergroup
+	e.push(migrated)
+	created := e.message(supergroup, "")
+	created.MigrateFromChatID = e.chat
+	e.push(created)
+
+	id := e.push(e.message(supergroup, "@warbot мы теперь супергруппа"))
+	calls, err := e.replies(2)
+	if err != nil {
+		return err
+	}
+	reply := slices.IndexFunc(calls, func(c fakeCall) bool { return c.Params.Get("reply_to_message_id") == id })
+	if reply == -1 {
+		return fmt.Errorf("no reply in the supergroup")
+	}
+	if err := checkParam(calls[reply], "chat_id", chatIDParam(supergroup)); err != nil {
+		return err
+	}
+	if n := len(e.fake.callsTo("leaveChat")); n != 0 {
+		return fmt.Errorf("leaveChat called %d times, want 0", n)
+	}
+	return e.checkRecipients(supergroup, e.config.OwnerID)
+}
+
+// e2eOverrides checks the per-chat probability, persona pool and language.
+func e2eOverrides(e *e2eEnv) error {
+	chat := e.config.Chats[1]
+	e.push(e.message(chat.ID, "Кто-нибудь видел новые миниатюры?"))
+	if _, err := e.replies(1); err != nil {
+		return err
+	}
+	prompt, err := e.lastPrompt()
+	if err != nil {
+		return err
+	}
+	system := prompt[0].Content
+	persona, _ := e.config.Personas.get(chat.Personas[0])
+	if !strings.Contains(system, persona.SystemPrompt) {
+		return fmt.Errorf("persona %s not used: %q", persona.ID, system)
+	}
+	if !strings.Contains(system, chat.Language) {
+		return fmt.Errorf("language %s missing from the prompt: %q", chat.Language, system)
+	}
+	return nil
+}
+
+// e2eTopics checks that forum topics keep their own context, are answered
+// in place and can be switched off.
+func e2eTopics(e *e2eEnv) error {
+	const chatter, offTopic = 7, 9
+	e.pushToTopic(e.message(e.chat, "В соседней теме обсуждаем покраску"), offTopic)
+	id := e.pushToTopic(e.message(e.chat, "@warbot что в этой теме?"), chatter)
+	calls, err := e.replies(1)
+	if err != nil {
+		return err
+	}
+	if err := checkParam(calls[0], "reply_to_message_id", id); err != nil {
+		return err
+	}
+	if err := checkParam(calls[0], "message_thread_id", strconv.Itoa(chatter)); err != nil {
+		return err
+	}
+	for _, call := range e.fake.callsTo("sendChatAction") {
+		if err := checkParam(call, "message_thread_id", strconv.Itoa(chatter)); err != nil {
+			return err
+		}
+	}
+	prompt, err := e.lastPrompt()
+	if err != nil {
+		return err
+	}
+	if hasTurn(prompt, "user", "покраску") {
+		return fmt.Errorf("another topic leaked into the prompt: %+v", prompt)
+	}
+
+	off := e.message(e.chat, "/topic off")
+	off.Entities = []tgbotapi.MessageEntity{{Type: "bot_command", Offset: 0, Length: len("/topic")}}
+	e.pushToTopic(off, offTopic)
+	calls, err = e.replies(2)
+	if err != nil {
+		return err
+	}
+	if err := checkParam(calls[1], "message_thread_id", strconv.Itoa(offTopic)); err != nil {
+		return err
+	}
+
+	ignored := e.pushToTopic(e.message(e.chat, "@warbot ты тут?"), offTopic)
+	// The answer in the other topic marks the point where the ignored
+	// mention has been handled too.
+	e.pushToTopic(e.message(e.chat, "@warbot а тут?"), chatter)
+	calls, err = e.replies(3)
+	if err != nil {
+		return err
+	}
+	for _, call := range calls {
+		if call.Params.Get("reply_to_message_id") == ignored {
+			return fmt.Errorf("answered in a topic that is off")
+		}
+	}
+	return nil
+}
+
+// e2eTopicRoot checks that the topic's root message, which every message
+// in a topic points at, is neither taken for a reply to the bot nor added
+// to the prompt.
+func e2eTopicRoot(e *e2eEnv) error {
+	const thread = 3
+	e.pushToTopic(e.message(e.chat, "Кто красит орков к выходным?"), thread)
+	id := e.pushToTopic(e.message(e.chat, "@warbot а ты что скажешь?"), thread)
+	calls, err := e.replies(1)
+	if err != nil {
+		return err
+	}
+	if len(calls) != 1 {
+		return fmt.Errorf("sendMessage called %d times, want 1", len(calls))
+	}
+	if err := checkParam(calls[0], "reply_to_message_id", id); err != nil {
+		return err
+	}
+
+	prompt, err := e.lastPrompt()
+	if err != nil {
+		return err
+	}
+	if !hasTurn(prompt, "user", "Кто красит орков к выходным?") {
+		return fmt.Errorf("topic history missing from the prompt: %+v", prompt)
+	}
+	for _, m := range prompt {
+		if m.Role == "user" && strings.HasSuffix(m.Content, ": ") {
+			return fmt.Errorf("topic root in the prompt: %+v", prompt)
+		}
+	}
+	return nil
+}
+
+// checkRecipients checks that every sendMessage went to one of chats, each
+// of them exactly once.
+func (e *e2eEnv) checkRecipients(chats ...int64) error {
+	calls := e.fake.callsTo("sendMessage")
+	var got []string
+	for _, c := range calls {
+		got = append(got, c.Params.Get("chat_id"))
+	}
+	var want []string
+	for _, id := range chats {
+		want = append(want, chatIDParam(id))
+	}
+	slices.Sort(got)
+	slices.Sort(want)
+	if !slices.Equal(got, want) {
+		return fmt.Errorf("sendMessage went to %v, want %v", got, want)
+	}
+	return nil
+}
+
+// e2eDocument checks that a text document is fetched through getFile and
+// read into the prompt.
+func e2eDocument(e *e2eEnv) error {
+	const roster = "Ростер: 2000 очков Астра Милитарум, три Леман Русса."
+	e.fake.addFile("roster", []byte(roster))
+
+	message := e.message(e.chat, "")
+	message.Caption = "@warbot оцени ростер"
+	message.Document = &tgbotapi.Document{FileID: "roster", FileName: "roster.txt", MimeType: "text/plain"}
+	e.push(message)
+	if _, err := e.replies(1); err != nil {
+		return err
+	}
+
+	files := e.fake.callsTo("getFile")
+	if len(files) != 1 {
+		return fmt.Errorf("getFile called %d times, want 1", len(files))
+	}
+	if err := checkParam(files[0], "file_id", "roster"); err != nil {
+		return err
+	}
+	prompt, err := e.lastPrompt()
+	if err != nil {
+		return err
+	}
+	if last := prompt[len(prompt)-1]; !strings.Contains(last.Content, roster) {
+		return fmt.Errorf("document missing from the prompt: %q", last.Content)
+	}
+	return nil
+}
+
+// e2eStreaming checks that a streamed reply is posted as a placeholder and
+// edited into the final text.
+func e2eStreaming(e *e2eEnv) error {
+	e.push(e.message(e.chat, "@warbot расскажи про Ересь Хоруса"))
+	edits, err := e.fake.waitCalls("editMessageText", 1, e.timeout)
+	if err != nil {
+		return err
+	}
+	sent := e.fake.callsTo("sendMessage")
+	if len(sent) != 1 {
+		return fmt.Errorf("sendMessage called %d times, want 1", len(sent))
+	}
+	if err := checkParam(sent[0], "text", streamPlaceholder); err != nil {
+		return err
+	}
+	last := edits[len(edits)-1]
+	if err := checkParam(last, "message_id", strconv.Itoa(sent[0].MessageID)); err != nil {
+		return err
+	}
+	return checkParam(last, "text", e.config.CannedResponses[0])
+}
@@ -0,0 +1,295 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+)
+
+// fakeCall is a Bot API request the fake server received.
+type fakeCall struct {
+	Method string
+	Params url.Values
+	// MessageID is the ID of the message a sendMessage call created.
+	MessageID int
+}
+
+// fakeTelegram is an in-process Bot API server. It hands out scripted
+// updates through getUpdates, answers the methods the bot uses and records
+// every call, so the whole bot runs against it without network access.
+type fakeTelegram struct {
+	server *httptest.Server
+	token  string
+	self   tgbotapi.User
+
+	mu      sync.Mutex
+	updates []json.RawMessage
+	calls   []fakeCall
+	files   map[string][]byte
+	lastID  int
+	// changed is closed and replaced whenever an update is pushed or a call
+	// recorded.
+	changed chan struct{}
+	// closed ends pending getUpdates calls.
+	closed    chan struct{}
+	closeOnce sync.Once
+}
+
+func newFakeTelegram(token string, self tgbotapi.User) *fakeTelegram {
+	f := &fakeTelegram{
+		token:   token,
+		self:    self,
+		files:   make(map[string][]byte),
+		changed: make(chan struct{}),
+		closed:  make(chan struct{}),
+	}
+	f.server = httptest.NewServer(http.HandlerFunc(f.serveHTTP))
+	return f
+}
+
+// URL is the value for telegram_api_url.
+func (f *fakeTelegram) URL() string {
+	return f.server.URL
+}
+
+// endPolling answers pending and later getUpdates calls at once, so a
+// stopped poller is not left waiting for the long poll.
+func (f *fakeTelegram) endPolling() {
+	f.closeOnce.Do(func() { close(f.closed) })
+}
+
+// Close ends pending getUpdates calls and stops the server.
+func (f *fakeTelegram) Close() {
+	f.endPolling()
+	f.server.Close()
+}
+
+// push queues an update for getUpdates, numbering it after the previous ones.
+// A message without an ID gets the next one, so user messages and the bot's
+// are ordered as in a real chat. It returns the message ID.
+func (f *fakeTelegram) push(update incomingUpdate) int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	update.UpdateID = len(f.updates) + 1
+	id := 0
+	if m := update.Message; m != nil {
+		if m.MessageID == 0 {
+			f.lastID++
+			m.MessageID = f.lastID
+		}
+		id = m.MessageID
+	}
+	f.updates = append(f.updates, encodeUpdate(update))
+	f.notify()
+	return id
+}
+
+// encodeUpdate is the reverse of decodeUpdate: it adds the topic fields
+// tgbotapi does not know to the message, and forum_topic_created to the
+// topic's root message it replies to.
+func encodeUpdate(update incomingUpdate) json.RawMessage {
+	data, _ := json.Marshal(update.Update)
+	if update.Message == nil || update.Topic == (topicInfo{}) {
+		return data
+	}
+	var fields map[string]any
+	json.Unmarshal(data, &fields)
+	message := fields["message"].(map[string]any)
+	message["message_thread_id"] = update.Topic.MessageThreadID
+	message["is_topic_message"] = update.Topic.IsTopicMessage
+	if root := update.Message.ReplyToMessage; root != nil && root.MessageID == update.Topic.MessageThreadID {
+		parent := message["reply_to_message"].(map[string]any)
+		parent["forum_topic_created"] = map[string]any{
+			"name":       "Тема " + strconv.Itoa(root.MessageID),
+			"icon_color": 7322096,
+		}
+	}
+	data, _ = json.Marshal(fields)
+	return data
+}
+
+// addFile makes data available through getFile and the file endpoint.
+func (f *fakeTelegram) addFile(fileID string, data []byte) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.files[fileID] = data
+}
+
+// callsTo returns the recorded calls of method.
+func (f *fakeTelegram) callsTo(method string) []fakeCall {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	var calls []fakeCall
+	for _, c := range f.calls {
+		if c.Method == method {
+			calls = append(calls, c)
+		}
+	}
+	return calls
+}
+
+// waitCalls waits until method has been called n times and returns the
+// calls, or fails after timeout.
+func (f *fakeTelegram) waitCalls(method string, n int, timeout time.Duration) ([]fakeCall, error) {
+	deadline := time.After(timeout)
+	for {
+		f.mu.Lock()
+		changed := f.changed
+		f.mu.Unlock()
+		if calls := f.callsTo(method); len(calls) >= n {
+			return calls, nil
+		}
+		select {
+		case <-changed:
+		case <-deadline:
+			return f.callsTo(method), fmt.Errorf("%s called %d times, want %d", method, len(f.callsTo(method)), n)
+		}
+	}
+}
+
+// notify wakes up everyone waiting for a change. f.mu must be held.
+func (f *fakeTelegram) notify() {
+	close(f.changed)
+	f.changed = make(chan struct{})
+}
+
+func (f *fakeTelegram) serveHTTP(w http.ResponseWriter, r *http.Request) {
+	if path, ok := strings.CutPrefix(r.URL.Path, "/file/bot"+f.token+"/"); ok {
+		f.serveFile(w, path)
+		return
+	}
+	method, ok := strings.CutPrefix(r.URL.Path, "/bot"+f.token+"/")
+	if !ok {
+		writeFakeError(w, http.StatusUnauthorized, "Unauthorized")
+		return
+	}
+	if err := r.ParseForm(); err != nil {
+		writeFakeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	if method == "getUpdates" {
+		f.getUpdates(w, r)
+		return
+	}
+
+	call := fakeCall{Method: method, Params: r.PostForm}
+	var sent tgbotapi.Message
+	if method == "sendMessage" {
+		sent = f.message(r.PostForm, 0)
+		call.MessageID = sent.MessageID
+	}
+	f.mu.Lock()
+	f.calls = append(f.calls, call)
+	f.notify()
+	f.mu.Unlock()
+
+	switch method {
+	case "getMe":
+		writeFakeResult(w, f.self)
+	case "sendMessage":
+		writeFakeResult(w, sent)
+	case "editMessageText":
+		id, _ := strconv.Atoi(r.PostForm.Get("message_id"))
+		writeFakeResult(w, f.message(r.PostForm, id))
+	case "getFile":
+		fileID := r.PostForm.Get("file_id")
+		f.mu.Lock()
+		_, ok := f.files[fileID]
+		f.mu.Unlock()
+		if !ok {
+			writeFakeError(w, http.StatusBadRequest, "Bad Request: invalid file_id")
+			return
+		}
+		writeFakeResult(w, tgbotapi.File{FileID: fileID, FilePath: "documents/" + fileID})
+	case "getChatAdministrators":
+		writeFakeResult(w, []tgbotapi.ChatMember{})
+	default:
+		// deleteWebhook, sendChatAction, leaveChat and the like.
+		writeFakeResult(w, true)
+	}
+}
+
+// message builds the message returned by sendMessage and editMessageText. A
+// new message gets the next free ID.
+func (f *fakeTelegram) message(params url.Values, id int) tgbotapi.Message {
+	if id == 0 {
+		f.mu.Lock()
+		f.lastID++
+		id = f.lastID
+		f.mu.Unlock()
+	}
+	chatID, _ := strconv.ParseInt(params.Get("chat_id"), 10, 64)
+	return tgbotapi.Message{
+		MessageID: id,
+		From:      &f.self,
+		Chat:      &tgbotapi.Chat{ID: chatID, Type: "supergroup"},
+		Date:      int(time.Now().Unix()),
+		Text:      params.Get("text"),
+	}
+}
+
+// getUpdates answers with the updates from offset on, waiting up to the
+// requested timeout for new ones like the real long polling.
+func (f *fakeTelegram) getUpdates(w http.ResponseWriter, r *http.Request) {
+	offset, _ := strconv.Atoi(r.PostForm.Get("offset"))
+	timeout, _ := strconv.Atoi(r.PostForm.Get("timeout"))
+	deadline := time.After(time.Duration(timeout) * time.Second)
+	for {
+		f.mu.Lock()
+		var pending []json.RawMessage
+		for i, u := range f.updates {
+			if i+1 >= offset {
+				pending = append(pending, u)
+			}
+		}
+		changed := f.changed
+		f.mu.Unlock()
+
+		if len(pending) > 0 || timeout == 0 {
+			writeFakeResult(w, pending)
+			return
+		}
+		select {
+		case <-changed:
+		case <-deadline:
+			writeFakeResult(w, []json.RawMessage{})
+			return
+		case <-r.Context().Done():
+			return
+		case <-f.closed:
+			return
+		}
+	}
+}
+
+func (f *fakeTelegram) serveFile(w http.ResponseWriter, path string) {
+	f.mu.Lock()
+	data, ok := f.files[strings.TrimPrefix(path, "documents/")]
+	f.mu.Unlock()
+	if !ok {
+		http.Error(w, "file not found", http.StatusNotFound)
+		return
+	}
+	w.Write(data)
+}
+
+func writeFakeResult(w http.ResponseWriter, result any) {
+	data, _ := json.Marshal(result)
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(tgbotapi.APIResponse{Ok: true, Result: data})
+}
+
+func writeFakeError(w http.ResponseWriter, status int, description string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(tgbotapi.APIResponse{ErrorCode: status, Description: description})
+}
@@ -1,14 +1,11 @@
 package main
 
 import (
-	"bytes"
+	"context"
 	"encoding/json"
 	"fmt"
 	"log"
-	"math/rand"
-	"net/http"
-	"slices"
-	"strconv"
+	"os"
 	"strings"
 	"time"
 
@@ -16,54 +13,168 @@ import (
 	"github.com/spf13/viper"
 )
 
+// Config is a snapshot of config.yaml. Fields tagged reload:"restart" are
+// read once at startup, everything else follows config reloads.
 type Config struct {
-	TelegramToken      string   `mapstructure:"telegram_token"`
-	DeepSeekAPIURL     string   `mapstructure:"deepseek_api_url"`
-	DeepSeekAPIKey     string   `mapstructure:"deepseek_api_key"`
-	TriggerProbability float64  `mapstructure:"trigger_probability"`
-	ChatID             int64    `mapstructure:"chat_id"`
-	DeepSeekModel      string   `mapstructure:"deepseek_model"`
-	MaxTokens          int      `mapstructure:"max_tokens"`
-	Temperature        float64  `mapstructure:"temperature"`
-	StoreUpdates       int      `mapstructure:"store_updates"`
-	Prompts            []string `mapstructure:"prompts"`
+	TelegramToken      string             `mapstructure:"telegram_token" reload:"restart" secret:"true"`
+	TelegramAPIURL     string             `mapstructure:"telegram_api_url" reload:"restart"`
+	Provider           string             `mapstructure:"provider" reload:"restart"`
+	DeepSeekAPIURL     string             `mapstructure:"deepseek_api_url" reload:"restart"`
+	DeepSeekAPIKey     string             `mapstructure:"deepseek_api_key" reload:"restart" secret:"true"`
+	AnthropicAPIURL    string             `mapstructure:"anthropic_api_url" reload:"restart"`
+	AnthropicAPIKey    string             `mapstructure:"anthropic_api_key" reload:"restart" secret:"true"`
+	AnthropicModel     string             `mapstructure:"anthropic_model"`
+	CannedResponses    []string           `mapstructure:"canned_responses" reload:"restart"`
+	TriggerProbability float64            `mapstructure:"trigger_probability"`
+	ChatID             int64              `mapstructure:"chat_id"`
+	Chats              []chatConfig       `mapstructure:"chats"`
+	OwnerID            int64              `mapstructure:"owner_id"`
+	Language           string             `mapstructure:"language"`
+	DeepSeekModel      string             `mapstructure:"deepseek_model"`
+	MaxTokens          int                `mapstructure:"max_tokens"`
+	Temperature        float64            `mapstructure:"temperature"`
+	StoreUpdates       int                `mapstructure:"store_updates" reload:"restart"`
+	StorePath          string             `mapstructure:"store_path" reload:"restart"`
+	HistoryMaxAge      time.Duration      `mapstructure:"history_max_age" reload:"restart"`
+	UpdateMode         string             `mapstructure:"update_mode" reload:"restart"`
+	WebhookURL         string             `mapstructure:"webhook_url" reload:"restart"`
+	WebhookListen      string             `mapstructure:"webhook_listen" reload:"restart"`
+	WebhookPathSecret  string             `mapstructure:"webhook_path_secret" reload:"restart" secret:"true"`
+	WebhookSecretToken string             `mapstructure:"webhook_secret_token" reload:"restart" secret:"true"`
+	WebhookCertFile    string             `mapstructure:"webhook_cert_file" reload:"restart"`
+	WebhookKeyFile     string             `mapstructure:"webhook_key_file" reload:"restart"`
+	ChatQueueSize      int                `mapstructure:"chat_queue_size" reload:"restart"`
+	LLMConcurrency     int                `mapstructure:"llm_concurrency" reload:"restart"`
+	AdminIDs           []int64            `mapstructure:"admin_ids"`
+	Prompts            []string           `mapstructure:"prompts"`
+	PersonasDir        string             `mapstructure:"personas_dir"`
+	ContextTokens      int                `mapstructure:"context_tokens"`
+	ModelContextTokens map[string]int     `mapstructure:"model_context_tokens"`
+	MaxMessageTokens   int                `mapstructure:"max_message_tokens"`
+	LLMTimeout         time.Duration      `mapstructure:"llm_timeout"`
+	LLMAttemptTimeout  time.Duration      `mapstructure:"llm_attempt_timeout" reload:"restart"`
+	LLMRetries         int                `mapstructure:"llm_retries" reload:"restart"`
+	LLMRetryBaseDelay  time.Duration      `mapstructure:"llm_retry_base_delay" reload:"restart"`
+	LLMRetryMaxDelay   time.Duration      `mapstructure:"llm_retry_max_delay" reload:"restart"`
+	BreakerFailures    int                `mapstructure:"breaker_failures" reload:"restart"`
+	BreakerCooldown    time.Duration      `mapstructure:"breaker_cooldown" reload:"restart"`
+	StreamReplies      bool               `mapstructure:"stream_replies"`
+	StreamEditInterval time.Duration      `mapstructure:"stream_edit_interval"`
+	MetricsListen      string             `mapstructure:"metrics_listen" reload:"restart"`
+	SoftDailyTokens    int                `mapstructure:"soft_daily_tokens"`
+	SoftMonthlyTokens  int                `mapstructure:"soft_monthly_tokens"`
+	HardDailyTokens    int                `mapstructure:"hard_daily_tokens"`
+	HardMonthlyTokens  int                `mapstructure:"hard_monthly_tokens"`
+	Triggers           []triggerRule      `mapstructure:"triggers"`
+	UserWeights        map[string]float64 `mapstructure:"user_weights"`
+	ReplyCooldown      time.Duration      `mapstructure:"reply_cooldown"`
+	MinMessageGap      int                `mapstructure:"min_message_gap"`
+	QuietHours         string             `mapstructure:"quiet_hours"`
+	TimeZone           string             `mapstructure:"time_zone"`
+
+	AdaptiveRepliesPerHour float64       `mapstructure:"adaptive_replies_per_hour"`
+	AdaptiveWindow         time.Duration `mapstructure:"adaptive_window"`
+	AdaptiveMinProbability float64       `mapstructure:"adaptive_min_probability"`
+	AdaptiveMaxProbability float64       `mapstructure:"adaptive_max_probability"`
+
+	Vision           bool `mapstructure:"vision"`
+	MaxImageBytes    int  `mapstructure:"max_image_bytes"`
+	MaxDocumentBytes int  `mapstructure:"max_document_bytes"`
+	DocumentTokens   int  `mapstructure:"document_tokens"`
+
+	STTURL           string        `mapstructure:"stt_url" reload:"restart"`
+	STTAPIKey        string        `mapstructure:"stt_api_key" reload:"restart" secret:"true"`
+	STTModel         string        `mapstructure:"stt_model" reload:"restart"`
+	STTLanguage      string        `mapstructure:"stt_language" reload:"restart"`
+	MaxVoiceBytes    int           `mapstructure:"max_voice_bytes"`
+	MaxVoiceDuration time.Duration `mapstructure:"max_voice_duration"`
+
+	Personas *personaRegistry `mapstructure:"-"`
+	Trigger  *triggerEngine   `mapstructure:"-"`
 }
 
-type deepSeekMessage struct {
-	Role    string `json:"role"`
-	Content string `json:"content"`
-}
+const defaultDeepSeekAPIURL = "https://api.deepseek.com/v1/chat/completions"
 
-type deepSeekRequest struct {
-	Model       string            `json:"model"`
-	Messages    []deepSeekMessage `json:"messages"`
-	MaxTokens   int               `json:"max_tokens"`
-	Temperature float64           `json:"temperature"`
+// contextBudget returns the input budget for the configured model.
+func (c *Config) contextBudget() contextBudget {
+	budget := contextBudget{InputTokens: c.ContextTokens, MessageTokens: c.MaxMessageTokens}
+	// viper lowercases map keys.
+	if n, ok := c.ModelContextTokens[strings.ToLower(c.Model())]; ok {
+		budget.InputTokens = n
+	}
+	return budget
 }
 
-type deepSeekResponse struct {
-	Choices []struct {
-		Message struct {
-			Content string `json:"content"`
-		} `json:"message"`
-	} `json:"choices"`
-	Error struct {
-		Message string `json:"message"`
-	} `json:"error"`
+// Model returns the model name for the configured provider.
+func (c *Config) Model() string {
+	if c.Provider == "anthropic" {
+		return c.AnthropicModel
+	}
+	return c.DeepSeekModel
 }
 
 func loadConfig() (*Config, error) {
+	setupConfig("")
+	config, err := decodeConfig()
+	if err != nil {
+		return nil, err
+	}
+	if config.TelegramToken == "" {
+		return nil, fmt.Errorf("telegram_token is required")
+	}
+	return config, nil
+}
+
+// setupConfig sets the defaults and reads the config file: config.yaml in
+// the working directory, or file when it is given, which then has to exist.
+func setupConfig(file string) error {
 	viper.SetConfigName("config")
 	viper.SetConfigType("yaml")
 	viper.AddConfigPath(".")
+	if file != "" {
+		viper.SetConfigFile(file)
+	}
 
-	viper.SetDefault("deepseek_api_url", "https://api.deepseek.com/v1/chat/completions")
+	viper.SetDefault("telegram_api_url", "https://api.telegram.org")
+	viper.SetDefault("provider", "openai")
+	viper.SetDefault("deepseek_api_url", defaultDeepSeekAPIURL)
+	viper.SetDefault("anthropic_api_url", "https://api.anthropic.com/v1/messages")
 	viper.SetDefault("trigger_probability", 0.1)
 	viper.SetDefault("deepseek_model", "deepseek-chat")
 	viper.SetDefault("max_tokens", 150)
 	viper.SetDefault("temperature", 0.8)
 	viper.SetDefault("bot_debug", true)
+	viper.SetDefault("personas_dir", "personas")
+	viper.SetDefault("context_tokens", 3000)
+	viper.SetDefault("max_message_tokens", 400)
+	viper.SetDefault("llm_timeout", 60*time.Second)
+	viper.SetDefault("llm_attempt_timeout", 30*time.Second)
+	viper.SetDefault("llm_retries", 3)
+	viper.SetDefault("llm_retry_base_delay", time.Second)
+	viper.SetDefault("llm_retry_max_delay", 20*time.Second)
+	viper.SetDefault("breaker_failures", 5)
+	viper.SetDefault("breaker_cooldown", time.Minute)
+	viper.SetDefault("stream_replies", false)
+	viper.SetDefault("stream_edit_interval", 3*time.Second)
 	viper.SetDefault("store_updates", 20)
+	viper.SetDefault("store_path", "data/history.jsonl")
+	viper.SetDefault("history_max_age", 7*24*time.Hour)
+	viper.SetDefault("update_mode", "polling")
+	viper.SetDefault("webhook_listen", ":8443")
+	viper.SetDefault("chat_queue_size", 10)
+	viper.SetDefault("llm_concurrency", 4)
+	viper.SetDefault("time_zone", "UTC")
+	viper.SetDefault("adaptive_window", time.Hour)
+	viper.SetDefault("adaptive_min_probability", 0.01)
+	viper.SetDefault("adaptive_max_probability", 0.3)
+	viper.SetDefault("vision", false)
+	viper.SetDefault("max_image_bytes", 5<<20)
+	viper.SetDefault("max_document_bytes", 64<<10)
+	viper.SetDefault("document_tokens", 1500)
+	viper.SetDefault("stt_model", "whisper-1")
+	viper.SetDefault("stt_language", "ru")
+	viper.SetDefault("max_voice_bytes", 2<<20)
+	viper.SetDefault("max_voice_duration", 2*time.Minute)
 	viper.SetDefault("prompts", []string{
 		"Ответь как мудрый инквизитор из вселенной Warhammer 40k на это сообщение но не больше 50 слов в ответе.",
 		"Ответь как орк из Warhammer 40k на это но не больше 50 слов в ответе. ",
@@ -89,218 +200,341 @@ func loadConfig() (*Config, error) {
 		"Ответь как хаос-культист из Warhammer 40k на это но не больше 50 слов в ответе. ",
 	})
 
-	viper.ReadInConfig()
+	err := viper.ReadInConfig()
 
 	viper.SetEnvPrefix("WHBOT")
 	viper.AutomaticEnv()
+	if file != "" {
+		return err
+	}
+	return nil
+}
 
+// decodeConfig builds and validates a Config from the current viper state.
+func decodeConfig() (*Config, error) {
 	var config Config
 	if err := viper.Unmarshal(&config); err != nil {
 		return nil, fmt.Errorf("unable to decode config into struct: %v", err)
 	}
 
-	if config.TelegramToken == "" {
-		return nil, fmt.Errorf("telegram_token is required")
+	switch config.Provider {
+	case "openai", "deepseek":
+		// Local OpenAI-compatible servers usually run without a key.
+		if config.DeepSeekAPIKey == "" && config.DeepSeekAPIURL == defaultDeepSeekAPIURL {
+			return nil, fmt.Errorf("deepseek_api_key is required")
+		}
+	case "anthropic":
+		if config.AnthropicAPIKey == "" {
+			return nil, fmt.Errorf("anthropic_api_key is required")
+		}
+		if config.AnthropicModel == "" {
+			return nil, fmt.Errorf("anthropic_model is required")
+		}
+	case "echo":
+	default:
+		return nil, fmt.Errorf("unknown provider %q", config.Provider)
+	}
+	if dirExists(config.PersonasDir) {
+		personas, err := loadPersonas(config.PersonasDir)
+		if err != nil {
+			return nil, fmt.Errorf("unable to load personas: %v", err)
+		}
+		config.Personas = personas
+	} else {
+		if len(config.Prompts) == 0 {
+			return nil, fmt.Errorf("prompts cant be empty")
+		}
+		config.Personas = personasFromPrompts(config.Prompts)
+	}
+	if err := validateChats(&config); err != nil {
+		return nil, err
 	}
-	if config.DeepSeekAPIKey == "" {
-		return nil, fmt.Errorf("deepseek_api_key is required")
+	trigger, err := newTriggerEngine(&config)
+	if err != nil {
+		return nil, err
+	}
+	config.Trigger = trigger
+	if err := validateAdaptive(&config); err != nil {
+		return nil, err
+	}
+	if config.LLMRetries < 1 {
+		return nil, fmt.Errorf("llm_retries must be at least 1")
+	}
+	if config.BreakerFailures < 1 {
+		return nil, fmt.Errorf("breaker_failures must be at least 1")
+	}
+	if config.ChatQueueSize < 1 {
+		return nil, fmt.Errorf("chat_queue_size must be at least 1")
+	}
+	if config.LLMConcurrency < 1 {
+		return nil, fmt.Errorf("llm_concurrency must be at least 1")
 	}
-	if len(config.Prompts) == 0 {
-		return nil, fmt.Errorf("prompts cant be empty")
+	if config.UpdateMode == "webhook" {
+		if config.WebhookURL == "" {
+			return nil, fmt.Errorf("webhook_url is required in webhook mode")
+		}
+		if config.WebhookPathSecret == "" {
+			return nil, fmt.Errorf("webhook_path_secret is required in webhook mode")
+		}
 	}
 
 	return &config, nil
 }
 
 func main() {
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "console":
+			runConsole(os.Args[2:])
+			return
+		case "replay":
+			runReplay(os.Args[2:])
+			return
+		}
+	}
+
 	config, err := loadConfig()
 	if err != nil {
 		log.Fatalf("Failed to load config: %v", err)
 	}
 
-	bot, err := tgbotapi.NewBotAPI(config.TelegramToken)
+	bot, err := newBotAPI(config)
 	if err != nil {
 		log.Panic(err)
 	}
 
 	log.Printf("Authorized on account %s", bot.Self.UserName)
 
-	u := tgbotapi.NewUpdate(0)
-	u.Timeout = 60
+	if config.MetricsListen != "" {
+		serveMetrics(config.MetricsListen)
+	}
 
-	updates := bot.GetUpdatesChan(u)
+	provider, err := newProvider(config)
+	if err != nil {
+		log.Fatalf("Failed to create provider: %v", err)
+	}
+	log.Printf("Using %s provider", provider.Name())
+	log.Printf("Loaded %d personas", len(config.Personas.personas))
 
-	var lastUpdates []tgbotapi.Update
-	var lastReplies []string
-	for update := range updates {
-		if update.Message == nil {
-			continue
-		}
+	configs := newConfigHolder(config)
+	configs.watch()
 
-		if config.ChatID != 0 && update.Message.Chat.ID != config.ChatID {
-			log.Printf("Message from unauthorized chat: %d", update.Message.Chat.ID)
-			continue
+	var store Store = memoryStore{}
+	if config.StorePath != "" {
+		store, err = newFileStore(config.StorePath)
+		if err != nil {
+			log.Fatalf("Failed to open store: %v", err)
 		}
+	}
+	defer store.Close()
 
-		lastUpdates = writeAndRotate(lastUpdates, update, config.StoreUpdates)
+	chats, err := newChatStates(store, retentionPolicy{
+		MaxMessages: config.StoreUpdates,
+		MaxAge:      config.HistoryMaxAge,
+	})
+	if err != nil {
+		log.Fatalf("Failed to load store: %v", err)
+	}
 
-		var replyContext string
-		for i, u := range lastReplies {
-			replyContext = replyContext + fmt.Sprintf("ответ %s: %s ;", strconv.Itoa(i), u)
-		}
+	p := newPipeline(newBotSender(bot, config), configs, provider, chats)
 
-		reply, err := handleMessage(bot, update.Message, config, lastUpdates, replyContext)
-		if err != nil {
-			continue
-		}
-		lastReplies = writeAndRotate(lastReplies, reply, config.StoreUpdates)
+	updates, err := receiveUpdates(context.Background(), bot, config)
+	if err != nil {
+		log.Fatalf("Failed to start receiving updates: %v", err)
 	}
+	ready.Store(true)
+
+	p.run(updates)
 }
 
-func sendMessage(bot *tgbotapi.BotAPI, chatID int64, text string, replyTo int) {
-	msg := tgbotapi.NewMessage(chatID, text)
-	msg.ReplyToMessageID = replyTo
+// newBotAPI connects to the Bot API server at telegram_api_url.
+func newBotAPI(config *Config) (*tgbotapi.BotAPI, error) {
+	return tgbotapi.NewBotAPIWithAPIEndpoint(config.TelegramToken,
+		strings.TrimRight(config.TelegramAPIURL, "/")+"/bot%s/%s")
+}
 
-	if _, err := bot.Send(msg); err != nil {
-		log.Printf("Error sending message: %v", err)
-	}
+func newBotSender(bot *tgbotapi.BotAPI, config *Config) botSender {
+	return botSender{BotAPI: bot, fileEndpoint: strings.TrimRight(config.TelegramAPIURL, "/") + "/file/bot%s/%s"}
 }
 
-func handleMessage(bot *tgbotapi.BotAPI, message *tgbotapi.Message,
-	config *Config, lastUpdates []tgbotapi.Update, lastResponses string) (reply string, err error) {
-	if len(message.Text) < 5 {
-		err = fmt.Errorf("Too short text")
-		return
+// newPipeline wires the provider into the concurrency limit, retries and
+// token budget, and queues replies per chat.
+func newPipeline(bot Sender, configs *configHolder, provider Provider, chats *chatStates) *pipeline {
+	config := configs.get()
+	p := &pipeline{
+		bot:     bot,
+		configs: configs,
+		chats:   chats,
+		stt:     newTranscriber(config),
+		clock:   systemClock{},
+		rand:    globalRandom{},
+	}
+	p.provider = &budgetProvider{
+		Provider: newResilientProvider(newLimitedProvider(&instrumentedProvider{provider}, config.LLMConcurrency), config),
+		exceeded: func() bool {
+			return configs.get().budgetLevel(chats.globalUsage(p.clock.Now())) == budgetHard
+		},
 	}
+	d := newDispatcher(config.ChatQueueSize, p.handle)
+	p.submit, p.wait = d.submit, d.wait
+	return p
+}
 
-	isMentioned := strings.Contains(strings.ToLower(message.Text), "@"+strings.ToLower(bot.Self.UserName))
+// replyPersona picks who answers message: the persona of the reply thread,
+// for unsolicited replies the persona whose keyword the message contains,
+// or the chat's persona of the day.
+func replyPersona(chats *chatStates, key chatKey, state chatState, message *tgbotapi.Message,
+	reason string, config *Config, now time.Time) *Persona {
+	if p := threadPersona(state, newChatMessage(message), config.Personas); p != nil {
+		return p
+	}
+	if reason == triggerKeyword || reason == triggerRandom {
+		if p := config.Personas.match(messageText(message)); p != nil {
+			return p
+		}
+	}
+	return chats.persona(key, now, config.Personas)
+}
 
-	var replyTo bool
+// sendMessage sends text in reply to replyTo. The message is dated now
+// unless Telegram reports its date.
+func sendMessage(bot Sender, key chatKey, text string, replyTo int, now time.Time) chatMessage {
+	msg := tgbotapi.NewMessage(key.ChatID, text)
+	msg.ReplyToMessageID = replyTo
 
-	if message.ReplyToMessage != nil &&
-		message.ReplyToMessage.From != nil &&
-		message.ReplyToMessage.From.ID == bot.Self.ID {
-		replyTo = true
+	sent, err := sendToThread(bot, msg, key.ThreadID)
+	if err != nil {
+		log.Printf("Error sending message: %v", err)
+		metricSendErrors.inc("sendMessage")
 	}
-
-	if !isMentioned && rand.Float64() > config.TriggerProbability && !replyTo {
-		err = fmt.Errorf("Conditions not met")
-		return
+	date := now.UTC()
+	if sent.Date != 0 {
+		date = time.Unix(int64(sent.Date), 0).UTC()
 	}
-
-	var chatContext string
-	for i, u := range lastUpdates {
-		chatContext = chatContext + fmt.Sprintf("сообщение от пользователя %s номер %s: %s ; ",
-			u.Message.From.UserName, strconv.Itoa(i), u.Message.Text)
+	return chatMessage{
+		MessageID: sent.MessageID,
+		ReplyTo:   replyTo,
+		UserID:    bot.Me().ID,
+		UserName:  bot.Me().UserName,
+		FromBot:   true,
+		Text:      text,
+		Date:      date,
 	}
-	chatContext = strings.TrimSpace(chatContext)
-
-	processedText := message.Text
-	if isMentioned {
-		processedText = strings.ReplaceAll(strings.ToLower(processedText), "@"+strings.ToLower(bot.Self.UserName), "")
-		processedText = strings.TrimSpace(processedText)
+}
 
-		if len(processedText) < 3 {
-			processedText = "Ты жалкий бот зачем ты существуешь"
-		}
-		if message.ReplyToMessage != nil {
-			processedText = processedText + message.ReplyToMessage.Text
-		}
+// editMessage replaces the text of a message the bot sent earlier.
+func editMessage(bot Sender, chatID int64, messageID int, text string) {
+	edit := tgbotapi.NewEditMessageText(chatID, messageID, text)
+	if _, err := bot.Request(edit); err != nil {
+		log.Printf("Error editing message: %v", err)
+		metricSendErrors.inc("editMessageText")
 	}
-	now := time.Now().UTC().Truncate(time.Hour * 24)
-	r := rand.New(rand.NewSource(now.Unix()))
+}
 
-	promptTemplate := config.Prompts[r.Intn(len(config.Prompts))]
+func handleMessage(bot Sender, provider Provider, clock Clock, rng Random, key chatKey, message *tgbotapi.Message,
+	reason string, config *Config, state chatState, persona *Persona) (reply chatMessage, usage tokenUsage, err error) {
+	typing := keepTyping(bot, key)
+	defer typing.stop()
 
-	prompt := fmt.Sprintf("По возможности используя историю сообщений чата - %s."+
-		"И твоих ответов в чате(старайся быть оригинальным и не повторяться, историят твоих ответов для понимания контекста) - %s."+
-		"То как надо отвечать - %s."+
-		"Само сообщение на которое нужно ответить - %s",
-		chatContext, lastResponses, promptTemplate, processedText)
+	req := buildRequest(bot, message, reason, config, state, persona)
 
-	log.Println("Request:", prompt)
+	ctx, cancel := context.WithTimeout(context.Background(), config.LLMTimeout)
+	defer cancel()
 
-	response, err := generateDeepSeekResponse(prompt, config)
+	if config.StreamReplies {
+		if reply, usage, ok := streamReply(ctx, bot, provider, clock, rng, key, message, req, persona, config, typing); ok {
+			return reply, usage, nil
+		}
+		log.Println("Unable to post the placeholder, sending the reply at once")
+	}
+
+	response, err := provider.Generate(ctx, req)
 	if err != nil {
 		log.Printf("Error generating response: %v", err)
-		fallbackResponses := []string{
-			"Мои астропатические способности ослабли...",
-			"Варпальные бури мешают связи!",
-			"Техножрецы проверяют связь с духом машины...",
-		}
-		response = fallbackResponses[rand.Intn(len(fallbackResponses))]
+		response.Text = persona.fallback(rng)
 	}
 
-	sendMessage(bot, message.Chat.ID, response, message.MessageID)
-	return response, nil
+	typing.stop()
+	return sendMessage(bot, key, response.Text, message.MessageID, clock.Now()), response.Usage, nil
 }
 
-func generateDeepSeekResponse(prompt string, config *Config) (string, error) {
-	requestBody := deepSeekRequest{
-		Model: config.DeepSeekModel,
-		Messages: []deepSeekMessage{
-			{
-				Role:    "user",
-				Content: prompt,
-			},
-		},
-		MaxTokens:   config.MaxTokens,
-		Temperature: config.Temperature,
-	}
+// buildRequest assembles the completion request for message: the persona,
+// the conversation and the attachments.
+func buildRequest(bot Sender, message *tgbotapi.Message, reason string,
+	config *Config, state chatState, persona *Persona) completionRequest {
+	processedText := messageText(message)
+	if reason == triggerMention {
+		processedText = strings.ReplaceAll(strings.ToLower(processedText), "@"+strings.ToLower(bot.Me().UserName), "")
+		processedText = strings.TrimSpace(processedText)
 
-	jsonData, err := json.Marshal(requestBody)
-	if err != nil {
-		return "", err
+		if len(processedText) < 3 && mediaLabel(message) == "" {
+			processedText = "Ты жалкий бот зачем ты существуешь"
+		}
 	}
 
-	req, err := http.NewRequest("POST", config.DeepSeekAPIURL, bytes.NewBuffer(jsonData))
-	if err != nil {
-		return "", err
+	media := loadAttachments(bot, message, config)
+	budget := config.contextBudget()
+	if budget.InputTokens > 0 {
+		budget.InputTokens = max(budget.InputTokens-media.tokens(), 1)
 	}
-
-	req.Header.Set("Content-Type", "application/json")
-	req.Header.Set("Authorization", "Bearer "+config.DeepSeekAPIKey)
-
-	client := &http.Client{Timeout: 30 * time.Second}
-	resp, err := client.Do(req)
-	if err != nil {
-		return "", err
+	messages, dropped := buildConversation(persona, config.Language, state, newChatMessage(message), processedText, budget)
+	if dropped > 0 {
+		log.Printf("Context budget reached, dropped %d oldest messages", dropped)
 	}
-	defer resp.Body.Close()
+	media.attach(messages)
 
-	var deepSeekResp deepSeekResponse
-	if err := json.NewDecoder(resp.Body).Decode(&deepSeekResp); err != nil {
-		return "", err
+	if data, err := json.Marshal(messages); err == nil {
+		log.Println("Request:", string(data))
 	}
 
-	if deepSeekResp.Error.Message != "" {
-		return "", fmt.Errorf("API error: %s", deepSeekResp.Error.Message)
+	return completionRequest{
+		Model:       config.Model(),
+		Messages:    messages,
+		MaxTokens:   persona.maxTokens(config),
+		Temperature: persona.temperature(config),
 	}
+}
 
-	if len(deepSeekResp.Choices) == 0 {
-		return "", fmt.Errorf("no choices in response")
+const streamPlaceholder = "…"
+
+// streamReply posts a placeholder and edits it while the reply streams in.
+// Edits are throttled to stay within Telegram's limits. A broken stream
+// falls back to a regular request and then to the persona's fallback line.
+// It returns false when the placeholder could not be posted.
+func streamReply(ctx context.Context, bot Sender, provider Provider, clock Clock, rng Random, key chatKey,
+	message *tgbotapi.Message, req completionRequest, persona *Persona, config *Config,
+	typing *typingIndicator) (chatMessage, tokenUsage, bool) {
+	reply := sendMessage(bot, key, streamPlaceholder, message.MessageID, clock.Now())
+	if reply.MessageID == 0 {
+		return reply, tokenUsage{}, false
 	}
 
-	return strings.TrimSpace(deepSeekResp.Choices[0].Message.Content), nil
-}
-
-func writeAndRotate[T any](s []T, v T, l int) []T {
-	if len(s) < l {
-		s = append(s, v)
-	} else {
-		rotate(s, 1)
-		s[(len(s) - 1)] = v
+	var text strings.Builder
+	shown := streamPlaceholder
+	edits := throttle{interval: config.StreamEditInterval, last: clock.Now()}
+	response, err := stream(ctx, provider, req, func(delta string) {
+		text.WriteString(delta)
+		current := strings.TrimSpace(text.String())
+		if current != "" && current != shown && edits.allow(clock.Now()) {
+			editMessage(bot, message.Chat.ID, reply.MessageID, current)
+			shown = current
+		}
+	})
+	usage := response.Usage
+	if err != nil || response.Text == "" {
+		log.Printf("Error streaming response: %v", err)
+		response, err = provider.Generate(ctx, req)
+		usage = usage.add(response.Usage)
+		if err != nil {
+			log.Printf("Error generating response: %v", err)
+			response.Text = persona.fallback(rng)
+		}
 	}
-	return s
-}
 
-func rotate[T any](s []T, k int) {
-	n := len(s)
-	if n == 0 {
-		return
+	typing.stop()
+	if response.Text != shown {
+		editMessage(bot, message.Chat.ID, reply.MessageID, response.Text)
 	}
-	k = k % n
-	slices.Reverse(s[:k])
-	slices.Reverse(s[k:])
-	slices.Reverse(s)
+	reply.Text = response.Text
+	return reply, usage, true
 }
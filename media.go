@@ -0,0 +1,180 @@
+package main
+
+import (
+	"encoding/base64"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"path"
+	"slices"
+	"strings"
+	"time"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+)
+
+// imagePart is a picture attached to a message, sent to vision models.
+type imagePart struct {
+	MediaType string
+	Data      []byte
+}
+
+func (img imagePart) dataURL() string {
+	return "data:" + img.MediaType + ";base64," + base64.StdEncoding.EncodeToString(img.Data)
+}
+
+// imageTokens is a rough input cost of one image, charged against the
+// context budget.
+const imageTokens = 800
+
+// attachments is what the bot could read from a message besides its text.
+type attachments struct {
+	Images []imagePart
+	// Document is the text of an attached .txt or .md file.
+	Document string
+}
+
+func (a attachments) tokens() int {
+	return len(a.Images)*imageTokens + estimateTokens(a.Document)
+}
+
+// attach adds the attachments to the last message of a conversation.
+func (a attachments) attach(messages []promptMessage) {
+	last := &messages[len(messages)-1]
+	last.Images = a.Images
+	if a.Document != "" {
+		last.Content += "\n\n" + a.Document
+	}
+}
+
+// textDocuments are the document extensions read as plain text.
+var textDocuments = []string{".txt", ".md"}
+
+var fileClient = &http.Client{Timeout: 30 * time.Second}
+
+// messageText returns the text of a message, or the caption of a photo or
+// document.
+func messageText(message *tgbotapi.Message) string {
+	if message.Text != "" {
+		return message.Text
+	}
+	return message.Caption
+}
+
+// mediaLabel names the attachment of a message for the history, or returns
+// an empty string for plain text.
+func mediaLabel(message *tgbotapi.Message) string {
+	switch {
+	case len(message.Photo) > 0:
+		return "фото"
+	case message.Document != nil:
+		return "документ " + message.Document.FileName
+	case message.Voice != nil:
+		return "голосовое"
+	}
+	return ""
+}
+
+// hasContent reports whether message gives the bot something to answer: a
+// few words of text or a transcript, a text document, or a photo or image
+// for vision models. Other files are never read, their label alone is not
+// worth a reply.
+func hasContent(message *tgbotapi.Message, config *Config) bool {
+	if len(messageText(message)) >= 5 {
+		return true
+	}
+	if config.Vision && len(message.Photo) > 0 {
+		return true
+	}
+	doc := message.Document
+	return doc != nil && (isTextDocument(doc.FileName) || config.Vision && isImageDocument(doc))
+}
+
+// loadAttachments downloads the photos and text documents of message. Images
+// are only fetched for vision models; everything that fails or is too large
+// is skipped, leaving the caption alone.
+func loadAttachments(bot Sender, message *tgbotapi.Message, config *Config) attachments {
+	var a attachments
+
+	if config.Vision {
+		if fileID, ok := pickPhoto(message.Photo, config.MaxImageBytes); ok {
+			if data, err := downloadFile(bot, fileID, config.MaxImageBytes); err != nil {
+				log.Printf("Error downloading photo: %v", err)
+			} else {
+				a.Images = append(a.Images, imagePart{MediaType: "image/jpeg", Data: data})
+			}
+		}
+	}
+
+	doc := message.Document
+	if doc == nil {
+		return a
+	}
+	switch {
+	case config.Vision && isImageDocument(doc):
+		data, err := downloadFile(bot, doc.FileID, config.MaxImageBytes)
+		if err != nil {
+			log.Printf("Error downloading image document: %v", err)
+			return a
+		}
+		a.Images = append(a.Images, imagePart{MediaType: doc.MimeType, Data: data})
+	case isTextDocument(doc.FileName):
+		data, err := downloadFile(bot, doc.FileID, config.MaxDocumentBytes)
+		if err != nil {
+			log.Printf("Error downloading document: %v", err)
+			return a
+		}
+		a.Document = truncateTokens(strings.ToValidUTF8(string(data), ""), config.DocumentTokens)
+	}
+	return a
+}
+
+func isTextDocument(name string) bool {
+	return slices.Contains(textDocuments, strings.ToLower(path.Ext(name)))
+}
+
+func isImageDocument(doc *tgbotapi.Document) bool {
+	return strings.HasPrefix(doc.MimeType, "image/")
+}
+
+// pickPhoto returns the largest size of a photo that fits into limit.
+// Telegram lists sizes from the smallest to the largest.
+func pickPhoto(sizes []tgbotapi.PhotoSize, limit int) (string, bool) {
+	for i := len(sizes) - 1; i >= 0; i-- {
+		if sizes[i].FileSize <= limit {
+			return sizes[i].FileID, true
+		}
+	}
+	return "", false
+}
+
+// downloadFile fetches a file from Telegram, refusing files over limit bytes.
+func downloadFile(bot Sender, fileID string, limit int) ([]byte, error) {
+	fileURL, err := bot.GetFileDirectURL(fileID)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := fileClient.Get(fileURL)
+	if err != nil {
+		// Keep the URL, which contains the bot token, out of the logs.
+		if urlErr, ok := err.(*url.Error); ok {
+			err = urlErr.Err
+		}
+		return nil, fmt.Errorf("download failed: %v", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("download failed: status %d", resp.StatusCode)
+	}
+
+	data, err := io.ReadAll(io.LimitReader(resp.Body, int64(limit)+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(data) > limit {
+		return nil, fmt.Errorf("file is larger than %d bytes", limit)
+	}
+	return data, nil
+}
@@ -0,0 +1,33 @@
+package main
+
+import (
+	"testing"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+)
+
+func TestHasContent(t *testing.T) {
+	photo := []tgbotapi.PhotoSize{{FileID: "photo", FileSize: 1000}}
+	tests := []struct {
+		name    string
+		message tgbotapi.Message
+		vision  bool
+		want    bool
+	}{
+		{"text", tgbotapi.Message{Text: "Кто играет сегодня?"}, false, true},
+		{"short text", tgbotapi.Message{Text: "ок"}, false, false},
+		{"text document", tgbotapi.Message{Document: &tgbotapi.Document{FileName: "roster.txt"}}, false, true},
+		{"pdf", tgbotapi.Message{Document: &tgbotapi.Document{FileName: "codex.pdf", MimeType: "application/pdf"}}, true, false},
+		{"image document", tgbotapi.Message{Document: &tgbotapi.Document{FileName: "army.png", MimeType: "image/png"}}, true, true},
+		{"image document without vision", tgbotapi.Message{Document: &tgbotapi.Document{FileName: "army.png", MimeType: "image/png"}}, false, false},
+		{"photo", tgbotapi.Message{Photo: photo}, true, true},
+		{"photo without vision", tgbotapi.Message{Photo: photo}, false, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := hasContent(&tt.message, &Config{Vision: tt.vision}); got != tt.want {
+				t.Errorf("hasContent() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,223 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// A small Prometheus text-format registry, enough for a handful of
+// counters and histograms without pulling in the client library.
+
+type collector interface {
+	write(w io.Writer)
+}
+
+var collectors []collector
+
+type counterVec struct {
+	name   string
+	help   string
+	labels []string
+
+	mu     sync.Mutex
+	values map[string]float64
+}
+
+func newCounterVec(name, help string, labels ...string) *counterVec {
+	c := &counterVec{name: name, help: help, labels: labels, values: make(map[string]float64)}
+	collectors = append(collectors, c)
+	return c
+}
+
+// add increases the counter for the given label values, in the order the
+// labels were declared.
+func (c *counterVec) add(v float64, labelValues ...string) {
+	key := formatLabels(c.labels, labelValues)
+	c.mu.Lock()
+	c.values[key] += v
+	c.mu.Unlock()
+}
+
+func (c *counterVec) inc(labelValues ...string) {
+	c.add(1, labelValues...)
+}
+
+func (c *counterVec) write(w io.Writer) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s counter\n", c.name, c.help, c.name)
+	if len(c.labels) == 0 && len(c.values) == 0 {
+		fmt.Fprintf(w, "%s 0\n", c.name)
+	}
+	keys := make([]string, 0, len(c.values))
+	for k := range c.values {
+		keys = append(keys, k)
+	}
+	slices.Sort(keys)
+	for _, k := range keys {
+		fmt.Fprintf(w, "%s%s %s\n", c.name, k, formatValue(c.values[k]))
+	}
+}
+
+type histogram struct {
+	name    string
+	help    string
+	buckets []float64
+
+	mu     sync.Mutex
+	counts []uint64
+	sum    float64
+	count  uint64
+}
+
+func newHistogram(name, help string, buckets ...float64) *histogram {
+	h := &histogram{name: name, help: help, buckets: buckets, counts: make([]uint64, len(buckets))}
+	collectors = append(collectors, h)
+	return h
+}
+
+func (h *histogram) observe(v float64) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	for i, b := range h.buckets {
+		if v <= b {
+			h.counts[i]++
+		}
+	}
+	h.sum += v
+	h.count++
+}
+
+func (h *histogram) write(w io.Writer) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s histogram\n", h.name, h.help, h.name)
+	for i, b := range h.buckets {
+		fmt.Fprintf(w, "%s_bucket{le=\"%s\"} %d\n", h.name, formatValue(b), h.counts[i])
+	}
+	fmt.Fprintf(w, "%s_bucket{le=\"+Inf\"} %d\n", h.name, h.count)
+	fmt.Fprintf(w, "%s_sum %s\n%s_count %d\n", h.name, formatValue(h.sum), h.name, h.count)
+}
+
+func formatLabels(names, values []string) string {
+	if len(names) == 0 {
+		return ""
+	}
+	pairs := make([]string, len(names))
+	for i, n := range names {
+		var v string
+		if i < len(values) {
+			v = values[i]
+		}
+		pairs[i] = fmt.Sprintf("%s=%q", n, v)
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+func formatValue(v float64) string {
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+var (
+	metricUpdates = newCounterVec("warbot_updates_received_total",
+		"Updates received from Telegram.")
+	metricTriggers = newCounterVec("warbot_triggers_total",
+		"Messages the bot decided to answer, by reason.", "reason")
+	metricLLMLatency = newHistogram("warbot_llm_request_duration_seconds",
+		"Duration of single LLM API calls.", 0.25, 0.5, 1, 2, 5, 10, 20, 30, 60)
+	metricLLMErrors = newCounterVec("warbot_llm_errors_total",
+		"Failed LLM API calls, by HTTP status or error kind.", "status")
+	metricTokens = newCounterVec("warbot_llm_tokens_total",
+		"Tokens used by LLM calls.", "type")
+	metricFallbacks = newCounterVec("warbot_fallbacks_total",
+		"Replies answered with a fallback line.")
+	metricSendErrors = newCounterVec("warbot_telegram_send_errors_total",
+		"Failed Telegram API calls, by method.", "method")
+)
+
+// errorStatus turns an LLM error into a short label value.
+func errorStatus(err error) string {
+	var apiErr *apiError
+	switch {
+	case errors.As(err, &apiErr):
+		return strconv.Itoa(apiErr.StatusCode)
+	case errors.Is(err, context.DeadlineExceeded):
+		return "timeout"
+	case errors.Is(err, context.Canceled):
+		return "canceled"
+	case errors.Is(err, errStreamCut):
+		return "stream_cut"
+	default:
+		return "error"
+	}
+}
+
+// instrumentedProvider records latency, errors and token usage of every
+// single API call.
+type instrumentedProvider struct {
+	Provider
+}
+
+func (p *instrumentedProvider) Generate(ctx context.Context, req completionRequest) (completionResponse, error) {
+	start := time.Now()
+	resp, err := p.Provider.Generate(ctx, req)
+	p.observe(start, resp, err)
+	return resp, err
+}
+
+func (p *instrumentedProvider) Stream(ctx context.Context, req completionRequest, onDelta func(string)) (completionResponse, error) {
+	start := time.Now()
+	resp, err := stream(ctx, p.Provider, req, onDelta)
+	p.observe(start, resp, err)
+	return resp, err
+}
+
+func (p *instrumentedProvider) observe(start time.Time, resp completionResponse, err error) {
+	metricLLMLatency.observe(time.Since(start).Seconds())
+	metricTokens.add(float64(resp.Usage.PromptTokens), "prompt")
+	metricTokens.add(float64(resp.Usage.CompletionTokens), "completion")
+	if err != nil {
+		metricLLMErrors.inc(errorStatus(err))
+	}
+}
+
+// ready is set once the bot receives updates.
+var ready atomic.Bool
+
+func serveMetrics(addr string) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/metrics", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+		for _, c := range collectors {
+			c.write(w)
+		}
+	})
+	mux.HandleFunc("/healthz", func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "ok\n")
+	})
+	mux.HandleFunc("/readyz", func(w http.ResponseWriter, r *http.Request) {
+		if !ready.Load() {
+			http.Error(w, "not ready", http.StatusServiceUnavailable)
+			return
+		}
+		io.WriteString(w, "ok\n")
+	})
+
+	go func() {
+		log.Fatalf("Metrics server stopped: %v", http.ListenAndServe(addr, mux))
+	}()
+	log.Printf("Serving metrics on %s", addr)
+}
@@ -0,0 +1,203 @@
+package main
+
+import (
+	"fmt"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/spf13/viper"
+)
+
+// Persona is a character the bot answers as. Keywords do not trigger a
+// reply, they pick the persona for unsolicited replies to messages
+// containing them.
+type Persona struct {
+	ID           string   `mapstructure:"id"`
+	Name         string   `mapstructure:"name"`
+	SystemPrompt string   `mapstructure:"system_prompt"`
+	Temperature  *float64 `mapstructure:"temperature"`
+	MaxTokens    int      `mapstructure:"max_tokens"`
+	Keywords     []string `mapstructure:"keywords"`
+	Weight       float64  `mapstructure:"weight"`
+	Fallbacks    []string `mapstructure:"fallbacks"`
+}
+
+// temperature returns the persona's sampling temperature, falling back to
+// the configured one.
+func (p *Persona) temperature(config *Config) float64 {
+	if p.Temperature != nil {
+		return *p.Temperature
+	}
+	return config.Temperature
+}
+
+func (p *Persona) maxTokens(config *Config) int {
+	if p.MaxTokens > 0 {
+		return p.MaxTokens
+	}
+	return config.MaxTokens
+}
+
+var defaultFallbacks = []string{
+	"Мои астропатические способности ослабли...",
+	"Варпальные бури мешают связи!",
+	"Техножрецы проверяют связь с духом машины...",
+}
+
+// fallback returns a random in-character line for when the LLM fails.
+func (p *Persona) fallback(rng Random) string {
+	metricFallbacks.inc()
+	lines := defaultFallbacks
+	if len(p.Fallbacks) > 0 {
+		lines = p.Fallbacks
+	}
+	return lines[int(rng.Float64()*float64(len(lines)))]
+}
+
+type personaRegistry struct {
+	personas []*Persona
+	byID     map[string]*Persona
+}
+
+var personaIDPattern = regexp.MustCompile(`^[a-z0-9_-]+$`)
+
+// loadPersonas reads every *.yaml file in dir. Any invalid file fails the
+// whole load so a typo never silently drops a persona.
+func loadPersonas(dir string) (*personaRegistry, error) {
+	files, err := filepath.Glob(filepath.Join(dir, "*.yaml"))
+	if err != nil {
+		return nil, err
+	}
+	if len(files) == 0 {
+		return nil, fmt.Errorf("no persona files in %s", dir)
+	}
+	slices.Sort(files)
+
+	r := &personaRegistry{byID: make(map[string]*Persona)}
+	for _, file := range files {
+		p, err := loadPersona(file)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", file, err)
+		}
+		if _, ok := r.byID[p.ID]; ok {
+			return nil, fmt.Errorf("%s: duplicate persona id %q", file, p.ID)
+		}
+		r.personas = append(r.personas, p)
+		r.byID[p.ID] = p
+	}
+	return r, nil
+}
+
+func loadPersona(file string) (*Persona, error) {
+	v := viper.New()
+	v.SetConfigFile(file)
+	v.SetConfigType("yaml")
+	v.SetDefault("weight", 1.0)
+	if err := v.ReadInConfig(); err != nil {
+		return nil, err
+	}
+
+	var p Persona
+	if err := v.UnmarshalExact(&p); err != nil {
+		return nil, err
+	}
+
+	switch {
+	case p.ID == "":
+		return nil, fmt.Errorf("id is required")
+	case !personaIDPattern.MatchString(p.ID):
+		return nil, fmt.Errorf("id %q may only contain a-z, 0-9, _ and -", p.ID)
+	case strings.TrimSpace(p.SystemPrompt) == "":
+		return nil, fmt.Errorf("system_prompt is required")
+	case p.Weight < 0:
+		return nil, fmt.Errorf("weight cant be negative")
+	case p.Temperature != nil && (*p.Temperature < 0 || *p.Temperature > 2):
+		return nil, fmt.Errorf("temperature must be between 0 and 2")
+	case p.MaxTokens < 0:
+		return nil, fmt.Errorf("max_tokens cant be negative")
+	}
+	if p.Name == "" {
+		p.Name = p.ID
+	}
+	for i, k := range p.Keywords {
+		p.Keywords[i] = strings.ToLower(k)
+	}
+	return &p, nil
+}
+
+// personasFromPrompts wraps the plain prompts list for configs without a
+// personas directory.
+func personasFromPrompts(prompts []string) *personaRegistry {
+	r := &personaRegistry{byID: make(map[string]*Persona)}
+	for i, prompt := range prompts {
+		p := &Persona{
+			ID:           "prompt-" + strconv.Itoa(i+1),
+			Name:         shorten(prompt, 40),
+			SystemPrompt: prompt,
+			Weight:       1,
+		}
+		r.personas = append(r.personas, p)
+		r.byID[p.ID] = p
+	}
+	return r
+}
+
+func (r *personaRegistry) get(id string) (*Persona, bool) {
+	p, ok := r.byID[id]
+	return p, ok
+}
+
+// subset returns a registry with only the personas in ids, in their order.
+func (r *personaRegistry) subset(ids []string) *personaRegistry {
+	sub := &personaRegistry{byID: make(map[string]*Persona)}
+	for _, id := range ids {
+		if p, ok := r.byID[id]; ok {
+			sub.personas = append(sub.personas, p)
+			sub.byID[id] = p
+		}
+	}
+	return sub
+}
+
+// pick chooses a persona at random, weighted by Weight.
+func (r *personaRegistry) pick(rng *rand.Rand) *Persona {
+	var total float64
+	for _, p := range r.personas {
+		total += p.Weight
+	}
+	if total <= 0 {
+		return r.personas[rng.Intn(len(r.personas))]
+	}
+
+	x := rng.Float64() * total
+	for _, p := range r.personas {
+		x -= p.Weight
+		if x < 0 {
+			return p
+		}
+	}
+	return r.personas[len(r.personas)-1]
+}
+
+// match returns the first persona with a keyword contained in text.
+func (r *personaRegistry) match(text string) *Persona {
+	text = strings.ToLower(text)
+	for _, p := range r.personas {
+		for _, k := range p.Keywords {
+			if strings.Contains(text, k) {
+				return p
+			}
+		}
+	}
+	return nil
+}
+
+func dirExists(dir string) bool {
+	info, err := os.Stat(dir)
+	return err == nil && info.IsDir()
+}
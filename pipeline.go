@@ -0,0 +1,260 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"math/rand"
+	"strconv"
+	"sync"
+	"time"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+)
+
+// Sender is the part of the Telegram Bot API the reply pipeline talks to.
+type Sender interface {
+	Me() tgbotapi.User
+	Send(c tgbotapi.Chattable) (tgbotapi.Message, error)
+	Request(c tgbotapi.Chattable) (*tgbotapi.APIResponse, error)
+	// MakeRequest calls a method with hand-made parameters, for the fields
+	// tgbotapi does not know.
+	MakeRequest(endpoint string, params tgbotapi.Params) (*tgbotapi.APIResponse, error)
+	GetFileDirectURL(fileID string) (string, error)
+	GetChatAdministrators(config tgbotapi.ChatAdministratorsConfig) ([]tgbotapi.ChatMember, error)
+}
+
+// botSender is the Sender backed by the real Bot API.
+type botSender struct {
+	*tgbotapi.BotAPI
+	// fileEndpoint is the download URL pattern of the configured server,
+	// tgbotapi always links files on api.telegram.org.
+	fileEndpoint string
+}
+
+func (b botSender) Me() tgbotapi.User { return b.Self }
+
+func (b botSender) GetFileDirectURL(fileID string) (string, error) {
+	file, err := b.GetFile(tgbotapi.FileConfig{FileID: fileID})
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf(b.fileEndpoint, b.Token, file.FilePath), nil
+}
+
+// Clock tells the time. Replays run on the dates of the recorded messages.
+type Clock interface {
+	Now() time.Time
+}
+
+type systemClock struct{}
+
+func (systemClock) Now() time.Time { return time.Now() }
+
+// Random is the source of trigger rolls.
+type Random interface {
+	Float64() float64
+}
+
+// globalRandom uses the package-level source, which is safe for concurrent
+// use.
+type globalRandom struct{}
+
+func (globalRandom) Float64() float64 { return rand.Float64() }
+
+// offlineSender stands in for Telegram in the console and in replays. A
+// sent message gets the ID of the message it answers plus one, so incoming
+// messages are numbered in steps of two.
+type offlineSender struct {
+	self  tgbotapi.User
+	clock Clock
+	// sent is called for every message the bot sends.
+	sent func(chatID int64, messageID int, text string)
+}
+
+func (s *offlineSender) Me() tgbotapi.User { return s.self }
+
+func (s *offlineSender) Send(c tgbotapi.Chattable) (tgbotapi.Message, error) {
+	msg, ok := c.(tgbotapi.MessageConfig)
+	if !ok {
+		return tgbotapi.Message{}, nil
+	}
+	return s.send(msg.ChatID, msg.ReplyToMessageID, msg.Text), nil
+}
+
+func (s *offlineSender) send(chatID int64, replyTo int, text string) tgbotapi.Message {
+	id := replyTo + 1
+	s.sent(chatID, id, text)
+	return tgbotapi.Message{
+		MessageID: id,
+		From:      &s.self,
+		Chat:      &tgbotapi.Chat{ID: chatID},
+		Date:      int(s.clock.Now().Unix()),
+		Text:      text,
+	}
+}
+
+func (s *offlineSender) Request(c tgbotapi.Chattable) (*tgbotapi.APIResponse, error) {
+	return &tgbotapi.APIResponse{Ok: true}, nil
+}
+
+func (s *offlineSender) MakeRequest(endpoint string, params tgbotapi.Params) (*tgbotapi.APIResponse, error) {
+	if endpoint != "sendMessage" {
+		return &tgbotapi.APIResponse{Ok: true}, nil
+	}
+	chatID, _ := strconv.ParseInt(params["chat_id"], 10, 64)
+	replyTo, _ := strconv.Atoi(params["reply_to_message_id"])
+	data, err := json.Marshal(s.send(chatID, replyTo, params["text"]))
+	return &tgbotapi.APIResponse{Ok: true, Result: data}, err
+}
+
+func (s *offlineSender) GetFileDirectURL(fileID string) (string, error) {
+	return "", fmt.Errorf("files are not available offline")
+}
+
+func (s *offlineSender) GetChatAdministrators(tgbotapi.ChatAdministratorsConfig) ([]tgbotapi.ChatMember, error) {
+	return nil, nil
+}
+
+// pipeline decides which updates to answer and answers them. Everything it
+// depends on is an interface, so the same code runs against Telegram and
+// against recorded updates.
+type pipeline struct {
+	bot      Sender
+	configs  *configHolder
+	provider Provider
+	chats    *chatStates
+	stt      Transcriber
+	clock    Clock
+	rand     Random
+	// submit queues a triggered job; handle runs it.
+	submit func(job)
+	// wait, when set, blocks until the submitted jobs are done.
+	wait func()
+	// decided, when set, is told the trigger decision for every message.
+	decided func(message *tgbotapi.Message, reason, detail string)
+	// persona, when set, answers every message instead of the chat's.
+	persona *Persona
+	// leaving holds the unauthorized chats the bot is leaving.
+	leaving sync.Map
+}
+
+// run receives updates until the channel is closed and waits for the
+// replies still in progress.
+func (p *pipeline) run(updates <-chan incomingUpdate) {
+	for update := range updates {
+		p.receive(update)
+	}
+	if p.wait != nil {
+		p.wait()
+	}
+}
+
+// receive records an update in the history and queues a reply when one of
+// the triggers fires.
+func (p *pipeline) receive(update incomingUpdate) {
+	metricUpdates.inc()
+	if update.MyChatMember != nil {
+		p.membership(update.MyChatMember)
+		return
+	}
+	message := update.Message
+	if message == nil {
+		return
+	}
+	switch {
+	case message.MigrateToChatID != 0:
+		p.migrate(message.Chat.ID, message.MigrateToChatID)
+		return
+	case message.MigrateFromChatID != 0:
+		p.migrate(message.MigrateFromChatID, message.Chat.ID)
+		return
+	}
+
+	key := chatKeyFor(update)
+	config, ok := p.config(message.Chat.ID)
+	if !ok {
+		log.Printf("Message from unauthorized chat: %d", message.Chat.ID)
+		p.trigger(key, update, "", "unauthorized chat")
+		if !message.Chat.IsPrivate() {
+			p.leave(message.Chat, nil)
+		}
+		return
+	}
+
+	if isBotCommand(p.bot, update.Message) {
+		p.trigger(key, update, triggerCommand, "command")
+		return
+	}
+	if key.ThreadID != 0 && p.chats.settings(key).TopicOff {
+		p.trigger(key, update, "", "topic is off")
+		return
+	}
+
+	if update.Message.Voice != nil && p.stt != nil {
+		// Transcription is slow, the chat's worker records the message
+		// once the transcript is ready.
+		p.submit(job{key: key, update: update, reason: triggerVoice})
+		return
+	}
+
+	p.chats.addMessage(key, newChatMessage(update.Message))
+	reason, detail := p.decide(update.Message, config, key)
+	p.trigger(key, update, reason, detail)
+}
+
+func (p *pipeline) trigger(key chatKey, update incomingUpdate, reason, detail string) {
+	if p.decided != nil {
+		p.decided(update.Message, reason, detail)
+	}
+	if reason == "" {
+		return
+	}
+	metricTriggers.inc(reason)
+	p.submit(job{key: key, update: update, reason: reason})
+}
+
+func (p *pipeline) decide(message *tgbotapi.Message, config *Config, key chatKey) (reason, detail string) {
+	return decideTrigger(p.bot, message, config, p.chats, key, p.clock.Now(), p.rand)
+}
+
+// handle runs a queued job: a command, a voice message waiting for its
+// transcript or a reply.
+func (p *pipeline) handle(j job) {
+	config, _ := p.config(j.key.ChatID)
+	if j.reason == triggerCommand {
+		handleCommand(&commandEnv{bot: p.bot, config: config, chats: p.chats, key: j.key, now: p.clock.Now()}, j.update.Message)
+		return
+	}
+	if j.reason == triggerVoice {
+		transcribeVoice(p.stt, p.bot, j.update.Message, config)
+		p.chats.addMessage(j.key, newChatMessage(j.update.Message))
+		reason, detail := p.decide(j.update.Message, config, j.key)
+		if p.decided != nil {
+			p.decided(j.update.Message, reason, detail)
+		}
+		if reason == "" {
+			return
+		}
+		metricTriggers.inc(reason)
+		j.reason = reason
+	}
+
+	state := withReplyParent(p.chats.snapshot(j.key), j.update.Message, p.bot.Me().ID)
+	persona := replyPersona(p.chats, j.key, state, j.update.Message, j.reason, config, p.clock.Now())
+	if p.persona != nil {
+		persona = p.persona
+	}
+
+	reply, usage, err := handleMessage(p.bot, p.provider, p.clock, p.rand, j.key, j.update.Message, j.reason, config, state, persona)
+	if err != nil {
+		log.Printf("Error handling message: %v", err)
+		return
+	}
+	// A reply that was never delivered must not count for the cooldown.
+	if reply.MessageID != 0 {
+		reply.Persona = persona.ID
+		p.chats.addReply(j.key, reply)
+	}
+	p.chats.addUsage(j.key, p.clock.Now(), usage)
+}
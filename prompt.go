@@ -0,0 +1,222 @@
+package main
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+)
+
+const systemPreamble = "Ты участник группового чата в Telegram. " +
+	"Сообщения пользователей приходят в формате «имя: текст». " +
+	"Старайся быть оригинальным и не повторять свои прошлые ответы."
+
+// contextBudget limits the size of the conversation sent to the model.
+type contextBudget struct {
+	InputTokens   int
+	MessageTokens int
+}
+
+// estimateTokens guesses the token count of text. About four bytes per
+// token holds well enough for both Latin and Cyrillic text.
+func estimateTokens(text string) int {
+	return len(text)/4 + 1
+}
+
+// messageOverhead is the per-message cost of role markers and separators.
+const messageOverhead = 4
+
+// truncateTokens cuts text to roughly n tokens.
+func truncateTokens(text string, n int) string {
+	if n <= 0 || estimateTokens(text) <= n {
+		return text
+	}
+	limit := n * 4
+	r := []rune(text)
+	size := 0
+	for i, c := range r {
+		size += len(string(c))
+		if size > limit {
+			return string(r[:i]) + "…"
+		}
+	}
+	return text
+}
+
+// replyChain follows target's ReplyTo links through the stored messages and
+// replies. The chain is returned oldest first and stops at the first
+// message that is no longer stored.
+func replyChain(state chatState, target chatMessage) []chatMessage {
+	byID := make(map[int]chatMessage, len(state.History)+len(state.Replies))
+	for _, m := range state.History {
+		byID[m.MessageID] = m
+	}
+	for _, r := range state.Replies {
+		if r.MessageID != 0 {
+			byID[r.MessageID] = r
+		}
+	}
+
+	var chain []chatMessage
+	seen := map[int]bool{target.MessageID: true}
+	for id := target.ReplyTo; id != 0 && !seen[id]; {
+		m, ok := byID[id]
+		if !ok {
+			break
+		}
+		seen[id] = true
+		chain = append(chain, m)
+		id = m.ReplyTo
+	}
+	slices.Reverse(chain)
+	return chain
+}
+
+// withReplyParent adds the message that message replies to when it is no
+// longer in the stored history, so the reply chain has at least one link.
+func withReplyParent(state chatState, message *tgbotapi.Message, botID int64) chatState {
+	parent := message.ReplyToMessage
+	if parent == nil {
+		return state
+	}
+	for _, m := range slices.Concat(state.History, state.Replies) {
+		if m.MessageID == parent.MessageID {
+			return state
+		}
+	}
+
+	m := newChatMessage(parent)
+	m.FromBot = parent.From != nil && parent.From.ID == botID
+	state.History = append(slices.Clone(state.History), m)
+	return state
+}
+
+// threadPersona returns the persona of the bot's latest reply in target's
+// reply chain, so a thread keeps talking to the same character.
+func threadPersona(state chatState, target chatMessage, personas *personaRegistry) *Persona {
+	chain := replyChain(state, target)
+	for i := len(chain) - 1; i >= 0; i-- {
+		if !chain[i].FromBot || chain[i].Persona == "" {
+			continue
+		}
+		if p, ok := personas.get(chain[i].Persona); ok {
+			return p
+		}
+	}
+	return nil
+}
+
+// buildConversation turns the chat state into a role-tagged conversation:
+// the persona and the reply language, if set, as the system prompt, chat
+// messages as user turns and the
+// bot's earlier replies as assistant turns. It ends with target, whose text
+// is replaced by targetText. Target's reply chain goes in first, then the
+// rest of the history is filled newest first until the budget runs out;
+// the number of dropped turns is returned.
+func buildConversation(persona *Persona, language string, state chatState, target chatMessage, targetText string,
+	budget contextBudget) (messages []promptMessage, dropped int) {
+	turns := make([]chatMessage, 0, len(state.History)+len(state.Replies))
+	for _, m := range state.History {
+		// Messages that arrived while the reply was queued are not part of
+		// the context yet.
+		if m.MessageID < target.MessageID {
+			turns = append(turns, m)
+		}
+	}
+	for _, r := range state.Replies {
+		// Replies that failed to send have no message ID.
+		if r.MessageID != 0 && r.MessageID < target.MessageID {
+			turns = append(turns, r)
+		}
+	}
+	slices.SortFunc(turns, func(a, b chatMessage) int {
+		return a.MessageID - b.MessageID
+	})
+
+	system := promptMessage{
+		Role:    "system",
+		Content: systemPreamble + "\n\n" + persona.SystemPrompt,
+	}
+	if language != "" {
+		system.Content += "\n\nОтвечай на языке: " + language + "."
+	}
+	last := promptMessage{
+		Role:    "user",
+		Content: userTurn(target.UserName, target.Media, truncateTokens(targetText, budget.MessageTokens)),
+	}
+	used := estimateTokens(system.Content) + estimateTokens(last.Content) + 2*messageOverhead
+
+	// Pick turns newest first, the reply chain before everything else.
+	order := make([]int, 0, len(turns))
+	inChain := make(map[int]bool)
+	for _, m := range replyChain(state, target) {
+		inChain[m.MessageID] = true
+	}
+	for pass := range 2 {
+		for i := len(turns) - 1; i >= 0; i-- {
+			if inChain[turns[i].MessageID] == (pass == 0) {
+				order = append(order, i)
+			}
+		}
+	}
+
+	picked := make([]promptMessage, len(turns))
+	full := false
+	for _, i := range order {
+		t := turns[i]
+		m := promptMessage{Role: "user", Content: userTurn(t.UserName, t.Media, truncateTokens(t.Text, budget.MessageTokens))}
+		if t.FromBot {
+			m = promptMessage{Role: "assistant", Content: truncateTokens(t.Text, budget.MessageTokens)}
+		}
+
+		cost := estimateTokens(m.Content) + messageOverhead
+		if full || budget.InputTokens > 0 && used+cost > budget.InputTokens {
+			// Once the budget runs out, older history is dropped even if
+			// it would fit, so the history has no gaps.
+			if !inChain[t.MessageID] {
+				full = true
+			}
+			dropped++
+			continue
+		}
+		used += cost
+		picked[i] = m
+	}
+
+	messages = []promptMessage{system}
+	for _, m := range picked {
+		if m.Role != "" {
+			messages = append(messages, m)
+		}
+	}
+	return append(messages, last), dropped
+}
+
+// userTurn formats a chat message as "name: text", with attachments as
+// "name: [фото] caption".
+func userTurn(name, media, text string) string {
+	if name == "" {
+		name = "аноним"
+	}
+	text = strings.TrimSpace(text)
+	if media != "" {
+		text = strings.TrimSpace("[" + media + "] " + text)
+	}
+	return fmt.Sprintf("%s: %s", name, text)
+}
+
+// mergeTurns joins consecutive messages with the same role, for APIs that
+// require user and assistant turns to alternate.
+func mergeTurns(messages []promptMessage) []promptMessage {
+	var merged []promptMessage
+	for _, m := range messages {
+		if n := len(merged); n > 0 && merged[n-1].Role == m.Role {
+			merged[n-1].Content += "\n" + m.Content
+			merged[n-1].Images = slices.Concat(merged[n-1].Images, m.Images)
+			continue
+		}
+		merged = append(merged, m)
+	}
+	return merged
+}
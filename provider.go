@@ -0,0 +1,460 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"hash/fnv"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Provider generates a chat completion for a list of messages.
+type Provider interface {
+	Name() string
+	Generate(ctx context.Context, req completionRequest) (completionResponse, error)
+}
+
+type completionRequest struct {
+	Model       string
+	Messages    []promptMessage
+	MaxTokens   int
+	Temperature float64
+}
+
+type completionResponse struct {
+	Text  string
+	Usage tokenUsage
+}
+
+// tokenUsage is the token count reported by the API.
+type tokenUsage struct {
+	PromptTokens     int `json:"prompt_tokens"`
+	CompletionTokens int `json:"completion_tokens"`
+}
+
+func (u tokenUsage) total() int {
+	return u.PromptTokens + u.CompletionTokens
+}
+
+func (u tokenUsage) add(o tokenUsage) tokenUsage {
+	return tokenUsage{
+		PromptTokens:     u.PromptTokens + o.PromptTokens,
+		CompletionTokens: u.CompletionTokens + o.CompletionTokens,
+	}
+}
+
+// estimateUsage guesses usage for APIs that do not report it.
+func estimateUsage(req completionRequest, text string) tokenUsage {
+	var prompt int
+	for _, m := range req.Messages {
+		prompt += estimateTokens(m.Content) + messageOverhead
+	}
+	return tokenUsage{PromptTokens: prompt, CompletionTokens: estimateTokens(text)}
+}
+
+// promptMessage is one turn of the conversation sent to any provider.
+type promptMessage struct {
+	Role    string `json:"role"`
+	Content string `json:"content"`
+	// Images are sent only to providers with vision support.
+	Images []imagePart `json:"-"`
+}
+
+// openAIMessage is a message whose content is either a string or a list
+// of text and image parts.
+type openAIMessage struct {
+	Role    string `json:"role"`
+	Content any    `json:"content"`
+}
+
+type openAIPart struct {
+	Type     string          `json:"type"`
+	Text     string          `json:"text,omitempty"`
+	ImageURL *openAIImageURL `json:"image_url,omitempty"`
+}
+
+type openAIImageURL struct {
+	URL string `json:"url"`
+}
+
+func openAIMessages(messages []promptMessage) []openAIMessage {
+	out := make([]openAIMessage, 0, len(messages))
+	for _, m := range messages {
+		if len(m.Images) == 0 {
+			out = append(out, openAIMessage{Role: m.Role, Content: m.Content})
+			continue
+		}
+		parts := []openAIPart{{Type: "text", Text: m.Content}}
+		for _, img := range m.Images {
+			parts = append(parts, openAIPart{Type: "image_url", ImageURL: &openAIImageURL{URL: img.dataURL()}})
+		}
+		out = append(out, openAIMessage{Role: m.Role, Content: parts})
+	}
+	return out
+}
+
+// newProvider builds the configured provider. Its HTTP clients have no
+// timeout of their own, a streamed reply may take longer than any fixed
+// limit: calls are bounded by the context, see llm_timeout.
+func newProvider(config *Config) (Provider, error) {
+	switch config.Provider {
+	case "openai", "deepseek":
+		return &openAIProvider{
+			url:    config.DeepSeekAPIURL,
+			apiKey: config.DeepSeekAPIKey,
+			client: &http.Client{},
+		}, nil
+	case "anthropic":
+		return &anthropicProvider{
+			url:    config.AnthropicAPIURL,
+			apiKey: config.AnthropicAPIKey,
+			client: &http.Client{},
+		}, nil
+	case "echo":
+		return &echoProvider{canned: config.CannedResponses}, nil
+	default:
+		return nil, fmt.Errorf("unknown provider %q", config.Provider)
+	}
+}
+
+// openAIProvider talks to any OpenAI-compatible /chat/completions endpoint:
+// DeepSeek, llama.cpp server, Ollama and the like.
+type openAIProvider struct {
+	url    string
+	apiKey string
+	client *http.Client
+}
+
+type deepSeekRequest struct {
+	Model       string          `json:"model"`
+	Messages    []openAIMessage `json:"messages"`
+	MaxTokens   int             `json:"max_tokens"`
+	Temperature float64         `json:"temperature"`
+	Stream      bool            `json:"stream,omitempty"`
+	// StreamOptions asks for a final chunk with token usage.
+	StreamOptions *struct {
+		IncludeUsage bool `json:"include_usage"`
+	} `json:"stream_options,omitempty"`
+}
+
+type deepSeekResponse struct {
+	Choices []struct {
+		Message struct {
+			Content string `json:"content"`
+		} `json:"message"`
+	} `json:"choices"`
+	Usage tokenUsage `json:"usage"`
+	Error struct {
+		Message string `json:"message"`
+	} `json:"error"`
+}
+
+func (p *openAIProvider) Name() string { return "openai" }
+
+func (p *openAIProvider) request(req completionRequest) deepSeekRequest {
+	return deepSeekRequest{
+		Model:       req.Model,
+		Messages:    openAIMessages(req.Messages),
+		MaxTokens:   req.MaxTokens,
+		Temperature: req.Temperature,
+	}
+}
+
+func (p *openAIProvider) headers() map[string]string {
+	headers := map[string]string{}
+	if p.apiKey != "" {
+		headers["Authorization"] = "Bearer " + p.apiKey
+	}
+	return headers
+}
+
+func (p *openAIProvider) Generate(ctx context.Context, req completionRequest) (completionResponse, error) {
+	var deepSeekResp deepSeekResponse
+	if err := postJSON(ctx, p.client, p.url, p.headers(), p.request(req), &deepSeekResp); err != nil {
+		return completionResponse{}, err
+	}
+
+	if deepSeekResp.Error.Message != "" {
+		return completionResponse{}, fmt.Errorf("API error: %s", deepSeekResp.Error.Message)
+	}
+
+	if len(deepSeekResp.Choices) == 0 {
+		return completionResponse{}, fmt.Errorf("no choices in response")
+	}
+
+	return completionResponse{
+		Text:  strings.TrimSpace(deepSeekResp.Choices[0].Message.Content),
+		Usage: deepSeekResp.Usage,
+	}, nil
+}
+
+// anthropicProvider talks to the Anthropic Messages API.
+type anthropicProvider struct {
+	url    string
+	apiKey string
+	client *http.Client
+}
+
+const anthropicVersion = "2023-06-01"
+
+type anthropicRequest struct {
+	Model       string             `json:"model"`
+	System      string             `json:"system,omitempty"`
+	Messages    []anthropicMessage `json:"messages"`
+	MaxTokens   int                `json:"max_tokens"`
+	Temperature float64            `json:"temperature"`
+	Stream      bool               `json:"stream,omitempty"`
+}
+
+// anthropicMessage is a message whose content is either a string or a
+// list of text and image blocks.
+type anthropicMessage struct {
+	Role    string `json:"role"`
+	Content any    `json:"content"`
+}
+
+type anthropicBlock struct {
+	Type   string                `json:"type"`
+	Text   string                `json:"text,omitempty"`
+	Source *anthropicImageSource `json:"source,omitempty"`
+}
+
+type anthropicImageSource struct {
+	Type      string `json:"type"`
+	MediaType string `json:"media_type"`
+	Data      string `json:"data"`
+}
+
+func anthropicMessages(messages []promptMessage) []anthropicMessage {
+	out := make([]anthropicMessage, 0, len(messages))
+	for _, m := range messages {
+		if len(m.Images) == 0 {
+			out = append(out, anthropicMessage{Role: m.Role, Content: m.Content})
+			continue
+		}
+		var blocks []anthropicBlock
+		for _, img := range m.Images {
+			blocks = append(blocks, anthropicBlock{Type: "image", Source: &anthropicImageSource{
+				Type:      "base64",
+				MediaType: img.MediaType,
+				Data:      base64.StdEncoding.EncodeToString(img.Data),
+			}})
+		}
+		blocks = append(blocks, anthropicBlock{Type: "text", Text: m.Content})
+		out = append(out, anthropicMessage{Role: m.Role, Content: blocks})
+	}
+	return out
+}
+
+type anthropicUsage struct {
+	InputTokens  int `json:"input_tokens"`
+	OutputTokens int `json:"output_tokens"`
+}
+
+type anthropicResponse struct {
+	Content []struct {
+		Type string `json:"type"`
+		Text string `json:"text"`
+	} `json:"content"`
+	Usage anthropicUsage `json:"usage"`
+	Error struct {
+		Message string `json:"message"`
+	} `json:"error"`
+}
+
+func (p *anthropicProvider) Name() string { return "anthropic" }
+
+func (p *anthropicProvider) request(req completionRequest) anthropicRequest {
+	requestBody := anthropicRequest{
+		Model:       req.Model,
+		MaxTokens:   req.MaxTokens,
+		Temperature: req.Temperature,
+	}
+
+	// The Messages API takes the system prompt as a separate field and
+	// rejects "system" roles inside the message list.
+	var system []string
+	var messages []promptMessage
+	for _, m := range req.Messages {
+		if m.Role == "system" {
+			system = append(system, m.Content)
+			continue
+		}
+		messages = append(messages, m)
+	}
+	requestBody.System = strings.Join(system, "\n\n")
+	messages = mergeTurns(messages)
+	if len(messages) > 0 && messages[0].Role != "user" {
+		// The conversation has to start with a user turn.
+		messages = append([]promptMessage{{Role: "user", Content: "..."}}, messages...)
+	}
+	requestBody.Messages = anthropicMessages(messages)
+	return requestBody
+}
+
+func (p *anthropicProvider) headers() map[string]string {
+	return map[string]string{
+		"x-api-key":         p.apiKey,
+		"anthropic-version": anthropicVersion,
+	}
+}
+
+func (p *anthropicProvider) Generate(ctx context.Context, req completionRequest) (completionResponse, error) {
+	var anthropicResp anthropicResponse
+	if err := postJSON(ctx, p.client, p.url, p.headers(), p.request(req), &anthropicResp); err != nil {
+		return completionResponse{}, err
+	}
+
+	if anthropicResp.Error.Message != "" {
+		return completionResponse{}, fmt.Errorf("API error: %s", anthropicResp.Error.Message)
+	}
+
+	var text strings.Builder
+	for _, c := range anthropicResp.Content {
+		if c.Type == "text" {
+			text.WriteString(c.Text)
+		}
+	}
+	if text.Len() == 0 {
+		return completionResponse{}, fmt.Errorf("no text content in response")
+	}
+
+	return completionResponse{
+		Text: strings.TrimSpace(text.String()),
+		Usage: tokenUsage{
+			PromptTokens:     anthropicResp.Usage.InputTokens,
+			CompletionTokens: anthropicResp.Usage.OutputTokens,
+		},
+	}, nil
+}
+
+// echoProvider answers without any network calls. With canned responses
+// configured it picks one deterministically from the prompt, otherwise it
+// echoes the last message back.
+type echoProvider struct {
+	canned []string
+}
+
+func (p *echoProvider) Name() string { return "echo" }
+
+func (p *echoProvider) Generate(ctx context.Context, req completionRequest) (completionResponse, error) {
+	if len(req.Messages) == 0 {
+		return completionResponse{}, fmt.Errorf("no messages in request")
+	}
+
+	text := "echo: " + req.Messages[len(req.Messages)-1].Content
+	if len(p.canned) > 0 {
+		h := fnv.New32a()
+		for _, m := range req.Messages {
+			h.Write([]byte(m.Content))
+		}
+		text = p.canned[int(h.Sum32()%uint32(len(p.canned)))]
+	}
+	return completionResponse{Text: text, Usage: estimateUsage(req, text)}, nil
+}
+
+// apiError is a non-2xx answer from an LLM API.
+type apiError struct {
+	StatusCode int
+	Message    string
+	RetryAfter time.Duration
+}
+
+func (e *apiError) Error() string {
+	return fmt.Sprintf("API error: status %d: %s", e.StatusCode, e.Message)
+}
+
+// temporary reports whether the request may succeed when retried.
+func (e *apiError) temporary() bool {
+	return e.StatusCode == http.StatusTooManyRequests ||
+		e.StatusCode == http.StatusRequestTimeout ||
+		e.StatusCode >= 500
+}
+
+func newAPIError(resp *http.Response) *apiError {
+	body, _ := io.ReadAll(io.LimitReader(resp.Body, 4096))
+
+	// Most APIs answer with {"error": {"message": ...}}, proxies and load
+	// balancers with an HTML page.
+	var parsed struct {
+		Error struct {
+			Message string `json:"message"`
+		} `json:"error"`
+	}
+	message := strings.TrimSpace(string(body))
+	if json.Unmarshal(body, &parsed) == nil && parsed.Error.Message != "" {
+		message = parsed.Error.Message
+	}
+	if message == "" {
+		message = http.StatusText(resp.StatusCode)
+	}
+
+	return &apiError{
+		StatusCode: resp.StatusCode,
+		Message:    shorten(message, 200),
+		RetryAfter: parseRetryAfter(resp.Header.Get("Retry-After"), time.Now()),
+	}
+}
+
+// parseRetryAfter reads a Retry-After header given in seconds or as a date.
+func parseRetryAfter(v string, now time.Time) time.Duration {
+	if v == "" {
+		return 0
+	}
+	if seconds, err := strconv.Atoi(v); err == nil && seconds > 0 {
+		return time.Duration(seconds) * time.Second
+	}
+	if t, err := http.ParseTime(v); err == nil && t.After(now) {
+		return t.Sub(now)
+	}
+	return 0
+}
+
+func postJSON(ctx context.Context, client *http.Client, url string, headers map[string]string, body, out any) error {
+	resp, err := post(ctx, client, url, headers, body)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if err := json.NewDecoder(resp.Body).Decode(out); err != nil {
+		return fmt.Errorf("unable to decode response: %v", err)
+	}
+	return nil
+}
+
+// post sends body as JSON and returns the response of a 2xx answer. Other
+// statuses are returned as *apiError.
+func post(ctx context.Context, client *http.Client, url string, headers map[string]string, body any) (*http.Response, error) {
+	jsonData, err := json.Marshal(body)
+	if err != nil {
+		return nil, err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, "POST", url, bytes.NewBuffer(jsonData))
+	if err != nil {
+		return nil, err
+	}
+
+	req.Header.Set("Content-Type", "application/json")
+	for k, v := range headers {
+		req.Header.Set(k, v)
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		defer resp.Body.Close()
+		return nil, newAPIError(resp)
+	}
+	return resp, nil
+}
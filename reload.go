@@ -0,0 +1,181 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"path/filepath"
+	"reflect"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+	"github.com/spf13/viper"
+)
+
+// reloadDebounce collapses the burst of events an editor produces on save.
+const reloadDebounce = 500 * time.Millisecond
+
+// configHolder keeps the current config snapshot. Readers call get once per
+// update or job and use that snapshot throughout.
+type configHolder struct {
+	current atomic.Pointer[Config]
+
+	mu    sync.Mutex // serialises reloads
+	timer *time.Timer
+}
+
+func newConfigHolder(config *Config) *configHolder {
+	h := &configHolder{}
+	h.current.Store(config)
+	return h
+}
+
+func (h *configHolder) get() *Config {
+	return h.current.Load()
+}
+
+// watch reloads the config when config.yaml or a persona file changes.
+// Editors save by replacing the file, so the directories are watched. The
+// global viper is only read again by reload, viper.WatchConfig would
+// re-read it on a goroutine of its own.
+func (h *configHolder) watch() {
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		log.Printf("Unable to watch the config: %v", err)
+		return
+	}
+
+	configFile, err := filepath.Abs(viper.ConfigFileUsed())
+	if err != nil {
+		log.Printf("Unable to watch the config: %v", err)
+		watcher.Close()
+		return
+	}
+	dirs := []string{filepath.Dir(configFile)}
+	personasDir := ""
+	if dir := h.get().PersonasDir; dirExists(dir) {
+		if personasDir, err = filepath.Abs(dir); err == nil {
+			dirs = append(dirs, personasDir)
+		}
+	}
+	for _, dir := range dirs {
+		if err := watcher.Add(dir); err != nil {
+			log.Printf("Unable to watch %s: %v", dir, err)
+		}
+	}
+
+	go func() {
+		for {
+			select {
+			case event, ok := <-watcher.Events:
+				if !ok {
+					return
+				}
+				name := filepath.Clean(event.Name)
+				if name == configFile ||
+					personasDir != "" && filepath.Dir(name) == personasDir && strings.HasSuffix(name, ".yaml") {
+					h.schedule()
+				}
+			case err, ok := <-watcher.Errors:
+				if !ok {
+					return
+				}
+				log.Printf("Config watcher error: %v", err)
+			}
+		}
+	}()
+}
+
+func (h *configHolder) schedule() {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.timer != nil {
+		h.timer.Stop()
+	}
+	h.timer = time.AfterFunc(reloadDebounce, h.reload)
+}
+
+// reload decodes and validates the config again and swaps it in. On any
+// error the previous snapshot stays active.
+func (h *configHolder) reload() {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if err := viper.ReadInConfig(); err != nil {
+		log.Printf("Config reload failed, keeping previous config: %v", err)
+		return
+	}
+	next, err := decodeConfig()
+	if err != nil {
+		log.Printf("Config reload failed, keeping previous config: %v", err)
+		return
+	}
+
+	prev := h.get()
+	changes, restart := configDiff(prev, next)
+	if len(restart) > 0 {
+		log.Printf("Config reload: changes to %s need a restart", strings.Join(restart, ", "))
+	}
+	if len(changes) == 0 {
+		return
+	}
+	for _, c := range changes {
+		log.Printf("Config reload: %s", c)
+	}
+	h.current.Store(next)
+}
+
+// configDiff describes what changed between two configs. Fields tagged
+// reload:"restart" keep their old value in next and are reported
+// separately.
+func configDiff(prev, next *Config) (changes, restart []string) {
+	pv := reflect.ValueOf(prev).Elem()
+	nv := reflect.ValueOf(next).Elem()
+	t := pv.Type()
+	for i := range t.NumField() {
+		field := t.Field(i)
+		key := field.Tag.Get("mapstructure")
+		if key == "-" {
+			continue
+		}
+		old, cur := pv.Field(i), nv.Field(i)
+		if reflect.DeepEqual(old.Interface(), cur.Interface()) {
+			continue
+		}
+		if field.Tag.Get("reload") == "restart" {
+			restart = append(restart, key)
+			cur.Set(old)
+			continue
+		}
+		if field.Tag.Get("secret") == "true" {
+			changes = append(changes, key+" changed")
+			continue
+		}
+		changes = append(changes, fmt.Sprintf("%s: %s -> %s", key, shorten(fmt.Sprint(old.Interface()), 80), shorten(fmt.Sprint(cur.Interface()), 80)))
+	}
+	changes = append(changes, personasDiff(prev.Personas, next.Personas)...)
+	return changes, restart
+}
+
+func personasDiff(prev, next *personaRegistry) []string {
+	var changes []string
+	for _, p := range next.personas {
+		old, ok := prev.get(p.ID)
+		switch {
+		case !ok:
+			changes = append(changes, "persona "+p.ID+" added")
+		case !reflect.DeepEqual(old, p):
+			changes = append(changes, "persona "+p.ID+" changed")
+		}
+	}
+	for _, p := range prev.personas {
+		if _, ok := next.get(p.ID); !ok {
+			changes = append(changes, "persona "+p.ID+" removed")
+		}
+	}
+	slices.Sort(changes)
+	return changes
+}
@@ -0,0 +1,245 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"math/rand"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+	"github.com/spf13/pflag"
+)
+
+// replayRecord is what the pipeline made of one recorded message.
+type replayRecord struct {
+	UpdateID  int             `json:"update_id"`
+	ChatID    int64           `json:"chat_id"`
+	ThreadID  int             `json:"thread_id,omitempty"`
+	MessageID int             `json:"message_id"`
+	From      string          `json:"from,omitempty"`
+	Text      string          `json:"text,omitempty"`
+	Decision  string          `json:"decision,omitempty"`
+	Detail    string          `json:"detail,omitempty"`
+	Persona   string          `json:"persona,omitempty"`
+	Prompt    []promptMessage `json:"prompt,omitempty"`
+	Replies   []string        `json:"replies,omitempty"`
+}
+
+// runReplay feeds a JSONL file of recorded Telegram updates through the
+// pipeline and writes one record per message: the trigger decision, the
+// prompt sent to the model and the replies. With --golden the records are
+// compared with a file written earlier by --update.
+func runReplay(args []string) {
+	flags := pflag.NewFlagSet("replay", pflag.ExitOnError)
+	configFile := flags.String("config", "", "config file, config.yaml in the working directory by default")
+	providerName := flags.String("provider", "echo", "provider answering the prompts, echo works offline")
+	seed := flags.Int64("seed", 1, "seed of the trigger rolls")
+	botName := flags.String("bot", "warbot", "user name of the bot in the recording")
+	botID := flags.Int64("bot-id", 1, "user ID of the bot in the recording")
+	golden := flags.String("golden", "", "compare the records with this file")
+	update := flags.Bool("update", false, "write the records to the --golden file instead of comparing")
+	verbose := flags.Bool("verbose", false, "show the log")
+	flags.Usage = func() {
+		fmt.Fprintln(os.Stderr, "Usage: barrens-warhammer replay [flags] updates.jsonl")
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+	if flags.NArg() != 1 || *update && *golden == "" {
+		flags.Usage()
+		os.Exit(2)
+	}
+
+	if !*verbose {
+		log.SetOutput(io.Discard)
+	}
+	config, provider := offlineConfig(*configFile, *providerName)
+
+	in, err := os.Open(flags.Arg(0))
+	if err != nil {
+		fatalf("%v", err)
+	}
+	defer in.Close()
+
+	var out bytes.Buffer
+	self := tgbotapi.User{ID: *botID, IsBot: true, UserName: *botName}
+	if err := replay(in, &out, config, provider, self, *seed); err != nil {
+		fatalf("%v", err)
+	}
+
+	switch {
+	case *update:
+		if err := os.WriteFile(*golden, out.Bytes(), 0o644); err != nil {
+			fatalf("%v", err)
+		}
+	case *golden != "":
+		want, err := os.ReadFile(*golden)
+		if err != nil {
+			fatalf("%v", err)
+		}
+		if diff := lineDiff(string(want), out.String()); diff != "" {
+			fatalf("Replay differs from %s:\n%s", *golden, diff)
+		}
+		fmt.Printf("Replay matches %s\n", *golden)
+	default:
+		os.Stdout.Write(out.Bytes())
+	}
+}
+
+// replayClock is set to the date of each recorded message.
+type replayClock struct {
+	now time.Time
+}
+
+func (c *replayClock) Now() time.Time { return c.now }
+
+// recordingProvider keeps the requests it was asked to answer.
+type recordingProvider struct {
+	Provider
+
+	mu       sync.Mutex
+	requests []completionRequest
+}
+
+func (p *recordingProvider) Generate(ctx context.Context, req completionRequest) (completionResponse, error) {
+	p.mu.Lock()
+	p.requests = append(p.requests, req)
+	p.mu.Unlock()
+	return p.Provider.Generate(ctx, req)
+}
+
+// take returns the requests recorded since the last call.
+func (p *recordingProvider) take() []completionRequest {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	requests := p.requests
+	p.requests = nil
+	return requests
+}
+
+// replay runs the updates in r through a pipeline with an offline sender,
+// a clock following the recording and seeded trigger rolls.
+func replay(r io.Reader, w io.Writer, config *Config, provider Provider, self tgbotapi.User, seed int64) error {
+	clock := &replayClock{}
+	chats, err := newChatStates(memoryStore{}, retentionPolicy{
+		MaxMessages: config.StoreUpdates,
+		MaxAge:      config.HistoryMaxAge,
+	})
+	if err != nil {
+		return err
+	}
+	chats.clock = clock
+
+	var record *replayRecord
+	recorder := &recordingProvider{Provider: provider}
+	p := &pipeline{
+		bot: &offlineSender{self: self, clock: clock, sent: func(_ int64, _ int, text string) {
+			record.Replies = append(record.Replies, text)
+		}},
+		configs:  newConfigHolder(config),
+		provider: recorder,
+		chats:    chats,
+		clock:    clock,
+		rand:     rand.New(rand.NewSource(seed)),
+		decided: func(_ *tgbotapi.Message, reason, detail string) {
+			record.Decision, record.Detail = reason, detail
+		},
+	}
+	p.submit = p.handle
+
+	enc := json.NewEncoder(w)
+	enc.SetEscapeHTML(false)
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(nil, 1<<20)
+	for line := 1; scanner.Scan(); line++ {
+		data := bytes.TrimSpace(scanner.Bytes())
+		if len(data) == 0 || data[0] == '#' {
+			continue
+		}
+		update, err := decodeUpdate(data)
+		if err != nil {
+			return fmt.Errorf("line %d: %v", line, err)
+		}
+		message := update.Message
+		if message == nil {
+			continue
+		}
+
+		key := chatKeyFor(update)
+		record = &replayRecord{
+			UpdateID:  update.UpdateID,
+			ChatID:    key.ChatID,
+			ThreadID:  key.ThreadID,
+			MessageID: message.MessageID,
+			Text:      messageText(message),
+		}
+		if message.From != nil {
+			record.From = message.From.UserName
+		}
+		// The offline sender numbers replies after the message they
+		// answer, which leaves room for them between recorded messages.
+		message.MessageID *= 2
+		if parent := message.ReplyToMessage; parent != nil {
+			if parent.From != nil && parent.From.ID == self.ID {
+				parent.MessageID = replayedReplyID(chats.snapshot(key), parent.MessageID)
+			} else {
+				parent.MessageID *= 2
+			}
+		}
+		clock.now = time.Unix(int64(message.Date), 0).UTC()
+		replies := len(chats.snapshot(key).Replies)
+
+		p.receive(update)
+
+		if requests := recorder.take(); len(requests) > 0 {
+			record.Prompt = requests[len(requests)-1].Messages
+		}
+		if state := chats.snapshot(key); len(state.Replies) > replies {
+			record.Persona = state.Replies[len(state.Replies)-1].Persona
+		}
+		if err := enc.Encode(record); err != nil {
+			return err
+		}
+	}
+	return scanner.Err()
+}
+
+// replayedReplyID finds the replayed bot reply that stands for the recorded
+// reply with ID id: the last one answering a message recorded before it.
+func replayedReplyID(state chatState, id int) int {
+	found := 0
+	for _, reply := range state.Replies {
+		if reply.MessageID < 2*id {
+			found = max(found, reply.MessageID)
+		}
+	}
+	return found
+}
+
+// lineDiff lists the lines that differ between want and got, or returns an
+// empty string when they are equal.
+func lineDiff(want, got string) string {
+	w := strings.Split(want, "\n")
+	g := strings.Split(got, "\n")
+	var b strings.Builder
+	for i := range max(len(w), len(g)) {
+		var wl, gl string
+		if i < len(w) {
+			wl = w[i]
+		}
+		if i < len(g) {
+			gl = g[i]
+		}
+		if wl != gl {
+			fmt.Fprintf(&b, "line %d:\n- %s\n+ %s\n", i+1, wl, gl)
+		}
+	}
+	return b.String()
+}
@@ -0,0 +1,59 @@
+package main
+
+import (
+	"bytes"
+	"flag"
+	"io"
+	"log"
+	"os"
+	"testing"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+)
+
+var updateGolden = flag.Bool("update", false, "rewrite the golden files")
+
+// TestReplay runs the recorded updates through the pipeline and compares
+// the decisions, prompts and replies with the golden file.
+func TestReplay(t *testing.T) {
+	const golden = "testdata/replay/golden.jsonl"
+	log.SetOutput(io.Discard)
+	defer log.SetOutput(os.Stderr)
+
+	if err := setupConfig("testdata/replay/config.yaml"); err != nil {
+		t.Fatal(err)
+	}
+	config, err := decodeConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	provider, err := newProvider(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	in, err := os.Open("testdata/replay/updates.jsonl")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer in.Close()
+
+	var out bytes.Buffer
+	self := tgbotapi.User{ID: 1, IsBot: true, UserName: "warbot"}
+	if err := replay(in, &out, config, provider, self, 1); err != nil {
+		t.Fatal(err)
+	}
+
+	if *updateGolden {
+		if err := os.WriteFile(golden, out.Bytes(), 0o644); err != nil {
+			t.Fatal(err)
+		}
+		return
+	}
+	want, err := os.ReadFile(golden)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if diff := lineDiff(string(want), out.String()); diff != "" {
+		t.Errorf("replay differs from %s, rerun with -update if the change is intended:\n%s", golden, diff)
+	}
+}
@@ -0,0 +1,177 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"math/rand"
+	"sync"
+	"time"
+)
+
+var (
+	errCircuitOpen = errors.New("circuit breaker is open")
+	// errAttemptTimeout ends a single slow attempt. Unlike the deadline of
+	// the whole reply it is retried.
+	errAttemptTimeout = errors.New("attempt timed out")
+)
+
+// retryPolicy is exponential backoff with full jitter.
+type retryPolicy struct {
+	Attempts  int
+	BaseDelay time.Duration
+	MaxDelay  time.Duration
+}
+
+// delay returns how long to wait before the given retry, starting at 1.
+// A Retry-After from the server wins over the computed backoff.
+func (p retryPolicy) delay(retry int, err error) time.Duration {
+	var apiErr *apiError
+	if errors.As(err, &apiErr) && apiErr.RetryAfter > 0 {
+		return min(apiErr.RetryAfter, p.MaxDelay)
+	}
+
+	backoff := p.BaseDelay << (retry - 1)
+	if backoff <= 0 || backoff > p.MaxDelay {
+		backoff = p.MaxDelay
+	}
+	return time.Duration(rand.Int63n(int64(backoff) + 1))
+}
+
+// retryable reports whether err is worth another attempt.
+func retryable(err error) bool {
+	if errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+		return false
+	}
+	var apiErr *apiError
+	if errors.As(err, &apiErr) {
+		return apiErr.temporary()
+	}
+	// Network errors, timeouts and broken bodies.
+	return true
+}
+
+// circuitBreaker stops calls to a provider that keeps failing. After
+// Failures consecutive errors it opens for Cooldown, then lets a single
+// trial call through.
+type circuitBreaker struct {
+	Failures int
+	Cooldown time.Duration
+
+	mu        sync.Mutex
+	failed    int
+	openUntil time.Time
+	trial     bool
+}
+
+func (b *circuitBreaker) allow(now time.Time) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.failed < b.Failures {
+		return true
+	}
+	if now.Before(b.openUntil) || b.trial {
+		return false
+	}
+	b.trial = true
+	return true
+}
+
+// record counts the outcome of an allowed call. A canceled call says
+// nothing about the provider, it only ends the trial.
+func (b *circuitBreaker) record(err error, now time.Time) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.trial = false
+	if errors.Is(err, context.Canceled) {
+		return
+	}
+	if err == nil {
+		if b.failed >= b.Failures {
+			log.Println("Circuit breaker closed, provider is back")
+		}
+		b.failed = 0
+		return
+	}
+
+	b.failed++
+	if b.failed >= b.Failures {
+		if now.After(b.openUntil) {
+			log.Printf("Circuit breaker open for %s after %d failures: %v", b.Cooldown, b.failed, err)
+		}
+		b.openUntil = now.Add(b.Cooldown)
+	}
+}
+
+// resilientProvider retries temporary failures and short-circuits while
+// the provider is down.
+type resilientProvider struct {
+	Provider
+	retry   retryPolicy
+	breaker *circuitBreaker
+	// attemptTimeout limits each attempt, 0 leaves only the caller's
+	// deadline.
+	attemptTimeout time.Duration
+}
+
+func newResilientProvider(p Provider, config *Config) *resilientProvider {
+	return &resilientProvider{
+		Provider: p,
+		retry: retryPolicy{
+			Attempts:  config.LLMRetries,
+			BaseDelay: config.LLMRetryBaseDelay,
+			MaxDelay:  config.LLMRetryMaxDelay,
+		},
+		breaker: &circuitBreaker{
+			Failures: config.BreakerFailures,
+			Cooldown: config.BreakerCooldown,
+		},
+		attemptTimeout: config.LLMAttemptTimeout,
+	}
+}
+
+func (p *resilientProvider) Generate(ctx context.Context, req completionRequest) (completionResponse, error) {
+	var err error
+	for attempt := 1; attempt <= p.retry.Attempts; attempt++ {
+		if !p.breaker.allow(time.Now()) {
+			return completionResponse{}, errCircuitOpen
+		}
+
+		var resp completionResponse
+		resp, err = p.attempt(ctx, req)
+		p.breaker.record(err, time.Now())
+		if err == nil {
+			return resp, nil
+		}
+		if !retryable(err) || attempt == p.retry.Attempts {
+			break
+		}
+
+		delay := p.retry.delay(attempt, err)
+		log.Printf("Attempt %d failed: %v, retrying in %s", attempt, err, delay.Round(time.Millisecond))
+		select {
+		case <-time.After(delay):
+		case <-ctx.Done():
+			return completionResponse{}, ctx.Err()
+		}
+	}
+	return completionResponse{}, err
+}
+
+// attempt makes a single call, cut after attemptTimeout.
+func (p *resilientProvider) attempt(ctx context.Context, req completionRequest) (completionResponse, error) {
+	if p.attemptTimeout <= 0 {
+		return p.Provider.Generate(ctx, req)
+	}
+	attemptCtx, cancel := context.WithTimeoutCause(ctx, p.attemptTimeout, errAttemptTimeout)
+	defer cancel()
+
+	resp, err := p.Provider.Generate(attemptCtx, req)
+	if err != nil && ctx.Err() == nil && errors.Is(context.Cause(attemptCtx), errAttemptTimeout) {
+		err = fmt.Errorf("%w after %s", errAttemptTimeout, p.attemptTimeout)
+	}
+	return resp, err
+}
@@ -0,0 +1,274 @@
+package main
+
+import (
+	"log"
+	"maps"
+	"math/rand"
+	"slices"
+	"sync"
+	"time"
+)
+
+// chatKey identifies a conversation: a chat, or a single forum topic
+// inside a chat.
+type chatKey struct {
+	ChatID   int64
+	ThreadID int
+}
+
+func chatKeyFor(update incomingUpdate) chatKey {
+	key := chatKey{ChatID: update.Message.Chat.ID}
+	// Replies in ordinary supergroups carry a message_thread_id too, only
+	// real forum topics get their own context.
+	if update.Topic.IsTopicMessage {
+		key.ThreadID = update.Topic.MessageThreadID
+	}
+	return key
+}
+
+// chat returns the key of the whole chat. Settings other than TopicOff are
+// kept there and apply to every topic.
+func (k chatKey) chat() chatKey {
+	return chatKey{ChatID: k.ChatID}
+}
+
+// chatState is everything the bot remembers about one conversation.
+type chatState struct {
+	History  []chatMessage
+	Replies  []chatMessage
+	Settings chatSettings
+	// Usage is token usage by UTC day, formatted as 2006-01-02.
+	Usage map[string]tokenUsage
+
+	// arrivals are the dates of recent messages, kept in memory only.
+	arrivals []time.Time
+}
+
+// chatStates holds the state of every conversation and writes each change
+// through to the store.
+type chatStates struct {
+	mu        sync.Mutex
+	chats     map[chatKey]*chatState
+	store     Store
+	retention retentionPolicy
+	// clock dates the retention limits.
+	clock Clock
+}
+
+func newChatStates(store Store, retention retentionPolicy) (*chatStates, error) {
+	chats, err := store.Load(retention)
+	if err != nil {
+		return nil, err
+	}
+	return &chatStates{chats: chats, store: store, retention: retention, clock: systemClock{}}, nil
+}
+
+// state returns the state for key. c.mu must be held.
+func (c *chatStates) state(key chatKey) *chatState {
+	state, ok := c.chats[key]
+	if !ok {
+		state = &chatState{Usage: make(map[string]tokenUsage)}
+		c.chats[key] = state
+	}
+	return state
+}
+
+// snapshot returns a copy of the state for key that is safe to use while
+// other goroutines keep updating it.
+func (c *chatStates) snapshot(key chatKey) chatState {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	state := c.state(key)
+	return chatState{
+		History:  slices.Clone(state.History),
+		Replies:  slices.Clone(state.Replies),
+		Settings: state.Settings,
+		Usage:    maps.Clone(state.Usage),
+	}
+}
+
+func (c *chatStates) addMessage(key chatKey, m chatMessage) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	state := c.state(key)
+	state.History = c.retention.add(state.History, m, c.clock.Now())
+	state.arrivals = append(state.arrivals, m.Date)
+	if len(state.arrivals) > maxArrivals {
+		state.arrivals = slices.Delete(state.arrivals, 0, len(state.arrivals)-maxArrivals)
+	}
+	if err := c.store.AppendMessage(key, m); err != nil {
+		log.Printf("Error storing message: %v", err)
+	}
+}
+
+func (c *chatStates) addReply(key chatKey, m chatMessage) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	state := c.state(key)
+	state.Replies = c.retention.add(state.Replies, m, c.clock.Now())
+	if err := c.store.AppendReply(key, m); err != nil {
+		log.Printf("Error storing reply: %v", err)
+	}
+}
+
+func (c *chatStates) addUsage(key chatKey, now time.Time, u tokenUsage) {
+	if u.total() == 0 {
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	state := c.state(key)
+	day := usageDay(now)
+	state.Usage[day] = state.Usage[day].add(u)
+	expireUsage(state.Usage, now)
+	if err := c.store.AppendUsage(key, day, u); err != nil {
+		log.Printf("Error storing usage: %v", err)
+	}
+}
+
+// usage returns the token usage of one chat, all its topics together, for
+// today and this month.
+func (c *chatStates) usage(chatID int64, now time.Time) (day, month tokenUsage) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for key, state := range c.chats {
+		if key.ChatID != chatID {
+			continue
+		}
+		d, m := sumUsage(state.Usage, now)
+		day, month = day.add(d), month.add(m)
+	}
+	return day, month
+}
+
+// globalUsage returns the token usage of all chats for today and this month.
+func (c *chatStates) globalUsage(now time.Time) (day, month tokenUsage) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for _, state := range c.chats {
+		d, m := sumUsage(state.Usage, now)
+		day, month = day.add(d), month.add(m)
+	}
+	return day, month
+}
+
+// chatActivity is what the trigger rules need to know about the bot's
+// recent replies in a chat.
+type chatActivity struct {
+	LastReply  time.Time
+	SinceReply int     // messages seen after the last reply
+	Rate       float64 // messages per hour over the adaptive window
+}
+
+func (c *chatStates) activity(key chatKey, now time.Time, window time.Duration) chatActivity {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	state := c.state(key)
+	rate := messageRate(state.arrivals, now, window)
+	if len(state.Replies) == 0 {
+		return chatActivity{SinceReply: len(state.History), Rate: rate}
+	}
+	last := state.Replies[len(state.Replies)-1]
+	activity := chatActivity{LastReply: last.Date, Rate: rate}
+	for _, m := range state.History {
+		if m.MessageID > last.MessageID {
+			activity.SinceReply++
+		}
+	}
+	return activity
+}
+
+// settings returns the settings of the chat with TopicOff of key's topic.
+func (c *chatStates) settings(key chatKey) chatSettings {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	s := c.state(key.chat()).Settings
+	s.TopicOff = c.state(key).Settings.TopicOff
+	return s
+}
+
+// updateSettings applies fn to the settings stored under key and stores the
+// result. Chat-wide settings go under key.chat().
+func (c *chatStates) updateSettings(key chatKey, fn func(*chatSettings)) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	fn(&c.state(key).Settings)
+	c.saveSettings(key)
+}
+
+// saveSettings stores the settings for key. c.mu must be held.
+func (c *chatStates) saveSettings(key chatKey) {
+	if err := c.store.SaveSettings(key, c.state(key).Settings); err != nil {
+		log.Printf("Error storing settings: %v", err)
+	}
+}
+
+// migrate copies the settings of every conversation in chat from to the
+// same conversation in chat to. History stays behind: a supergroup numbers
+// its messages anew, so the old ones could never be replied to. It returns
+// false when the migration was already done.
+func (c *chatStates) migrate(from, to int64) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	target := chatKey{ChatID: to}
+	if c.state(target).Settings.MigratedFrom == from {
+		return false
+	}
+	for key, state := range c.chats {
+		if key.ChatID != from {
+			continue
+		}
+		moved := chatKey{ChatID: to, ThreadID: key.ThreadID}
+		c.state(moved).Settings = state.Settings
+		if moved != target {
+			c.saveSettings(moved)
+		}
+	}
+	c.state(target).Settings.MigratedFrom = from
+	c.saveSettings(target)
+	return true
+}
+
+// migratedFrom returns the group chatID was upgraded from, or 0.
+func (c *chatStates) migratedFrom(chatID int64) int64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if state, ok := c.chats[chatKey{ChatID: chatID}]; ok {
+		return state.Settings.MigratedFrom
+	}
+	return 0
+}
+
+// persona returns the chat's active persona, picking a new one once a day
+// unless an admin locked it. The pick is seeded by day and chat so it
+// survives restarts.
+func (c *chatStates) persona(key chatKey, now time.Time, personas *personaRegistry) *Persona {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	key = key.chat()
+	s := &c.state(key).Settings
+	day := now.UTC().Truncate(time.Hour * 24)
+	p, ok := personas.get(s.Persona)
+	if !ok || (!s.PersonaLocked && !s.PersonaDay.Equal(day)) {
+		r := rand.New(rand.NewSource(day.Unix() ^ key.ChatID))
+		p = personas.pick(r)
+		s.Persona = p.ID
+		s.PersonaDay = day
+		s.PersonaLocked = false
+		c.saveSettings(key)
+	}
+	return p
+}
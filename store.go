@@ -0,0 +1,360 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"slices"
+	"sync"
+	"time"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+)
+
+// chatMessage is a stored chat message or bot reply.
+type chatMessage struct {
+	MessageID int    `json:"message_id"`
+	ReplyTo   int    `json:"reply_to,omitempty"`
+	UserID    int64  `json:"user_id,omitempty"`
+	UserName  string `json:"user_name,omitempty"`
+	FromBot   bool   `json:"from_bot,omitempty"`
+	// Media names the attachment of a message, such as a photo.
+	Media string `json:"media,omitempty"`
+	// Persona is the persona a bot reply was written as.
+	Persona string    `json:"persona,omitempty"`
+	Text    string    `json:"text"`
+	Date    time.Time `json:"date"`
+}
+
+func newChatMessage(message *tgbotapi.Message) chatMessage {
+	m := chatMessage{
+		MessageID: message.MessageID,
+		Text:      messageText(message),
+		Media:     mediaLabel(message),
+		Date:      time.Unix(int64(message.Date), 0).UTC(),
+	}
+	if message.ReplyToMessage != nil {
+		m.ReplyTo = message.ReplyToMessage.MessageID
+	}
+	if message.From != nil {
+		m.UserID = message.From.ID
+		m.UserName = message.From.UserName
+		if m.UserName == "" {
+			m.UserName = message.From.FirstName
+		}
+	}
+	return m
+}
+
+// chatSettings are the per-chat values that survive restarts.
+type chatSettings struct {
+	Persona       string    `json:"persona_id"`
+	PersonaDay    time.Time `json:"persona_day"`
+	PersonaLocked bool      `json:"persona_locked,omitempty"`
+	Probability   *float64  `json:"probability,omitempty"`
+	MutedUntil    time.Time `json:"muted_until,omitzero"`
+	QuietHours    string    `json:"quiet_hours,omitempty"`
+	TimeZone      string    `json:"time_zone,omitempty"`
+	// TopicOff silences the bot in a forum topic, except for commands.
+	TopicOff bool `json:"topic_off,omitempty"`
+	// MigratedFrom is the group this supergroup was upgraded from.
+	MigratedFrom int64 `json:"migrated_from,omitempty"`
+}
+
+// probability returns the chat's trigger probability, falling back to the
+// adaptive or the configured one.
+func (s chatSettings) probability(config *Config, activity chatActivity) float64 {
+	if s.Probability != nil {
+		return *s.Probability
+	}
+	if config.AdaptiveRepliesPerHour > 0 {
+		return adaptiveProbability(config, activity.Rate)
+	}
+	return config.TriggerProbability
+}
+
+func (s chatSettings) muted(now time.Time) bool {
+	return now.Before(s.MutedUntil)
+}
+
+// retentionPolicy limits how much history is kept per chat.
+type retentionPolicy struct {
+	MaxMessages int
+	MaxAge      time.Duration
+}
+
+// add appends m to s, dropping the oldest messages beyond the limits.
+func (p retentionPolicy) add(s []chatMessage, m chatMessage, now time.Time) []chatMessage {
+	if p.MaxMessages > 0 {
+		s = writeAndRotate(s, m, p.MaxMessages)
+	} else {
+		s = append(s, m)
+	}
+	return p.expire(s, now)
+}
+
+func (p retentionPolicy) expire(s []chatMessage, now time.Time) []chatMessage {
+	if p.MaxAge <= 0 {
+		return s
+	}
+	cutoff := now.Add(-p.MaxAge)
+	return slices.DeleteFunc(s, func(m chatMessage) bool {
+		return m.Date.Before(cutoff)
+	})
+}
+
+// Store persists chat history, bot replies, chat settings and token usage.
+type Store interface {
+	Load(retention retentionPolicy) (map[chatKey]*chatState, error)
+	AppendMessage(key chatKey, m chatMessage) error
+	AppendReply(key chatKey, m chatMessage) error
+	SaveSettings(key chatKey, s chatSettings) error
+	AppendUsage(key chatKey, day string, u tokenUsage) error
+	Close() error
+}
+
+// memoryStore keeps nothing, state lives only as long as the process.
+type memoryStore struct{}
+
+func (memoryStore) Load(retentionPolicy) (map[chatKey]*chatState, error) {
+	return map[chatKey]*chatState{}, nil
+}
+func (memoryStore) AppendMessage(chatKey, chatMessage) error      { return nil }
+func (memoryStore) AppendReply(chatKey, chatMessage) error        { return nil }
+func (memoryStore) SaveSettings(chatKey, chatSettings) error      { return nil }
+func (memoryStore) AppendUsage(chatKey, string, tokenUsage) error { return nil }
+func (memoryStore) Close() error                                  { return nil }
+
+const (
+	recordMessage  = "message"
+	recordReply    = "reply"
+	recordSettings = "settings"
+	recordUsage    = "usage"
+)
+
+type storeRecord struct {
+	Kind     string        `json:"kind"`
+	ChatID   int64         `json:"chat_id"`
+	ThreadID int           `json:"thread_id,omitempty"`
+	Message  *chatMessage  `json:"message,omitempty"`
+	Settings *chatSettings `json:"settings,omitempty"`
+	Day      string        `json:"day,omitempty"`
+	Usage    *tokenUsage   `json:"usage,omitempty"`
+}
+
+// compactEvery is how many appended records trigger a rewrite of the log.
+const compactEvery = 1000
+
+// fileStore is an append-only JSONL log. On load and every compactEvery
+// appends it is rewritten with only the records the retention policy keeps.
+type fileStore struct {
+	mu        sync.Mutex
+	path      string
+	file      *os.File
+	retention retentionPolicy
+	appended  int
+}
+
+func newFileStore(path string) (*fileStore, error) {
+	if dir := filepath.Dir(path); dir != "" {
+		if err := os.MkdirAll(dir, 0o755); err != nil {
+			return nil, err
+		}
+	}
+	return &fileStore{path: path}, nil
+}
+
+func (s *fileStore) Load(retention retentionPolicy) (map[chatKey]*chatState, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.retention = retention
+	chats, err := s.read()
+	if err != nil {
+		return nil, err
+	}
+	if err := s.rewrite(chats); err != nil {
+		return nil, err
+	}
+	return chats, nil
+}
+
+func (s *fileStore) AppendMessage(key chatKey, m chatMessage) error {
+	return s.append(storeRecord{Kind: recordMessage, ChatID: key.ChatID, ThreadID: key.ThreadID, Message: &m})
+}
+
+func (s *fileStore) AppendReply(key chatKey, m chatMessage) error {
+	return s.append(storeRecord{Kind: recordReply, ChatID: key.ChatID, ThreadID: key.ThreadID, Message: &m})
+}
+
+func (s *fileStore) SaveSettings(key chatKey, settings chatSettings) error {
+	return s.append(storeRecord{Kind: recordSettings, ChatID: key.ChatID, ThreadID: key.ThreadID, Settings: &settings})
+}
+
+func (s *fileStore) AppendUsage(key chatKey, day string, u tokenUsage) error {
+	return s.append(storeRecord{Kind: recordUsage, ChatID: key.ChatID, ThreadID: key.ThreadID, Day: day, Usage: &u})
+}
+
+func (s *fileStore) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.file == nil {
+		return nil
+	}
+	err := s.file.Close()
+	s.file = nil
+	return err
+}
+
+func (s *fileStore) append(rec storeRecord) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.file == nil {
+		return fmt.Errorf("store is not loaded")
+	}
+
+	data, err := json.Marshal(rec)
+	if err != nil {
+		return err
+	}
+	if _, err := s.file.Write(append(data, '\n')); err != nil {
+		return err
+	}
+
+	s.appended++
+	if s.appended >= compactEvery {
+		chats, err := s.read()
+		if err != nil {
+			return err
+		}
+		return s.rewrite(chats)
+	}
+	return nil
+}
+
+// read replays the log into chat states. Broken lines, usually a write cut
+// short by a crash, are logged and skipped.
+func (s *fileStore) read() (map[chatKey]*chatState, error) {
+	chats := make(map[chatKey]*chatState)
+
+	f, err := os.Open(s.path)
+	if os.IsNotExist(err) {
+		return chats, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	now := time.Now()
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 64*1024), 4*1024*1024)
+	for line := 1; scanner.Scan(); line++ {
+		var rec storeRecord
+		if err := json.Unmarshal(scanner.Bytes(), &rec); err != nil {
+			log.Printf("Skipping broken store record %s:%d: %v", s.path, line, err)
+			continue
+		}
+
+		key := chatKey{ChatID: rec.ChatID, ThreadID: rec.ThreadID}
+		state, ok := chats[key]
+		if !ok {
+			state = &chatState{Usage: make(map[string]tokenUsage)}
+			chats[key] = state
+		}
+
+		switch {
+		case rec.Kind == recordMessage && rec.Message != nil:
+			state.History = s.retention.add(state.History, *rec.Message, now)
+		case rec.Kind == recordReply && rec.Message != nil:
+			state.Replies = s.retention.add(state.Replies, *rec.Message, now)
+		case rec.Kind == recordSettings && rec.Settings != nil:
+			state.Settings = *rec.Settings
+		case rec.Kind == recordUsage && rec.Usage != nil:
+			state.Usage[rec.Day] = state.Usage[rec.Day].add(*rec.Usage)
+		default:
+			log.Printf("Skipping unknown store record %s:%d", s.path, line)
+		}
+	}
+	for _, state := range chats {
+		expireUsage(state.Usage, now)
+	}
+	return chats, scanner.Err()
+}
+
+// rewrite replaces the log with a snapshot of chats and reopens it for
+// appending.
+func (s *fileStore) rewrite(chats map[chatKey]*chatState) error {
+	tmp := s.path + ".tmp"
+	f, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+
+	w := bufio.NewWriter(f)
+	enc := json.NewEncoder(w)
+	for key, state := range chats {
+		settings := state.Settings
+		records := []storeRecord{{Kind: recordSettings, ChatID: key.ChatID, ThreadID: key.ThreadID, Settings: &settings}}
+		for i := range state.History {
+			records = append(records, storeRecord{Kind: recordMessage, ChatID: key.ChatID, ThreadID: key.ThreadID, Message: &state.History[i]})
+		}
+		for i := range state.Replies {
+			records = append(records, storeRecord{Kind: recordReply, ChatID: key.ChatID, ThreadID: key.ThreadID, Message: &state.Replies[i]})
+		}
+		for day, u := range state.Usage {
+			records = append(records, storeRecord{Kind: recordUsage, ChatID: key.ChatID, ThreadID: key.ThreadID, Day: day, Usage: &u})
+		}
+		for _, rec := range records {
+			if err := enc.Encode(rec); err != nil {
+				f.Close()
+				return err
+			}
+		}
+	}
+	if err := w.Flush(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+
+	if s.file != nil {
+		s.file.Close()
+		s.file = nil
+	}
+	if err := os.Rename(tmp, s.path); err != nil {
+		return err
+	}
+
+	s.file, err = os.OpenFile(s.path, os.O_APPEND|os.O_WRONLY|os.O_CREATE, 0o644)
+	s.appended = 0
+	return err
+}
+
+func writeAndRotate[T any](s []T, v T, l int) []T {
+	if len(s) < l {
+		s = append(s, v)
+	} else {
+		rotate(s, 1)
+		s[(len(s) - 1)] = v
+	}
+	return s
+}
+
+func rotate[T any](s []T, k int) {
+	n := len(s)
+	if n == 0 {
+		return
+	}
+	k = k % n
+	slices.Reverse(s[:k])
+	slices.Reverse(s[k:])
+	slices.Reverse(s)
+}
@@ -0,0 +1,198 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+)
+
+// StreamingProvider is a Provider that can deliver the reply piece by piece.
+// onDelta gets every new piece of text as it arrives.
+type StreamingProvider interface {
+	Provider
+	Stream(ctx context.Context, req completionRequest, onDelta func(string)) (completionResponse, error)
+}
+
+// stream uses p.Stream when p supports it and Generate otherwise.
+func stream(ctx context.Context, p Provider, req completionRequest, onDelta func(string)) (completionResponse, error) {
+	if s, ok := p.(StreamingProvider); ok {
+		return s.Stream(ctx, req, onDelta)
+	}
+	resp, err := p.Generate(ctx, req)
+	if err == nil {
+		onDelta(resp.Text)
+	}
+	return resp, err
+}
+
+var errStreamCut = errors.New("stream ended before completion")
+
+// readSSE calls onEvent for every event in a server-sent events stream
+// until onEvent reports the end of the stream.
+func readSSE(r io.Reader, onEvent func(event, data string) (done bool, err error)) error {
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+
+	var event string
+	for scanner.Scan() {
+		line := scanner.Text()
+		switch {
+		case line == "":
+			event = ""
+		case strings.HasPrefix(line, "event:"):
+			event = strings.TrimSpace(strings.TrimPrefix(line, "event:"))
+		case strings.HasPrefix(line, "data:"):
+			done, err := onEvent(event, strings.TrimSpace(strings.TrimPrefix(line, "data:")))
+			if err != nil || done {
+				return err
+			}
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+	return errStreamCut
+}
+
+func (p *openAIProvider) Stream(ctx context.Context, req completionRequest, onDelta func(string)) (completionResponse, error) {
+	body := p.request(req)
+	body.Stream = true
+	body.StreamOptions = &struct {
+		IncludeUsage bool `json:"include_usage"`
+	}{IncludeUsage: true}
+
+	resp, err := post(ctx, p.client, p.url, p.headers(), body)
+	if err != nil {
+		return completionResponse{}, err
+	}
+	defer resp.Body.Close()
+
+	var text strings.Builder
+	var usage tokenUsage
+	err = readSSE(resp.Body, func(_, data string) (bool, error) {
+		if data == "[DONE]" {
+			return true, nil
+		}
+
+		var chunk struct {
+			Choices []struct {
+				Delta struct {
+					Content string `json:"content"`
+				} `json:"delta"`
+			} `json:"choices"`
+			Usage *tokenUsage `json:"usage"`
+			Error struct {
+				Message string `json:"message"`
+			} `json:"error"`
+		}
+		if err := json.Unmarshal([]byte(data), &chunk); err != nil {
+			return false, fmt.Errorf("unable to decode stream chunk: %v", err)
+		}
+		if chunk.Error.Message != "" {
+			return false, fmt.Errorf("API error: %s", chunk.Error.Message)
+		}
+		if chunk.Usage != nil {
+			usage = *chunk.Usage
+		}
+		if len(chunk.Choices) > 0 && chunk.Choices[0].Delta.Content != "" {
+			text.WriteString(chunk.Choices[0].Delta.Content)
+			onDelta(chunk.Choices[0].Delta.Content)
+		}
+		return false, nil
+	})
+	return completionResponse{Text: strings.TrimSpace(text.String()), Usage: usage}, err
+}
+
+func (p *anthropicProvider) Stream(ctx context.Context, req completionRequest, onDelta func(string)) (completionResponse, error) {
+	body := p.request(req)
+	body.Stream = true
+
+	resp, err := post(ctx, p.client, p.url, p.headers(), body)
+	if err != nil {
+		return completionResponse{}, err
+	}
+	defer resp.Body.Close()
+
+	var text strings.Builder
+	var usage tokenUsage
+	err = readSSE(resp.Body, func(event, data string) (bool, error) {
+		var chunk struct {
+			Message struct {
+				Usage anthropicUsage `json:"usage"`
+			} `json:"message"`
+			Delta struct {
+				Type string `json:"type"`
+				Text string `json:"text"`
+			} `json:"delta"`
+			Usage anthropicUsage `json:"usage"`
+			Error struct {
+				Message string `json:"message"`
+			} `json:"error"`
+		}
+		switch event {
+		case "message_stop":
+			return true, nil
+		case "error":
+			json.Unmarshal([]byte(data), &chunk)
+			return false, fmt.Errorf("API error: %s", chunk.Error.Message)
+		case "message_start":
+			if err := json.Unmarshal([]byte(data), &chunk); err == nil {
+				usage.PromptTokens = chunk.Message.Usage.InputTokens
+			}
+		case "message_delta":
+			if err := json.Unmarshal([]byte(data), &chunk); err == nil {
+				usage.CompletionTokens = chunk.Usage.OutputTokens
+			}
+		case "content_block_delta":
+			if err := json.Unmarshal([]byte(data), &chunk); err != nil {
+				return false, fmt.Errorf("unable to decode stream chunk: %v", err)
+			}
+			if chunk.Delta.Type == "text_delta" && chunk.Delta.Text != "" {
+				text.WriteString(chunk.Delta.Text)
+				onDelta(chunk.Delta.Text)
+			}
+		}
+		return false, nil
+	})
+	return completionResponse{Text: strings.TrimSpace(text.String()), Usage: usage}, err
+}
+
+func (p *limitedProvider) Stream(ctx context.Context, req completionRequest, onDelta func(string)) (completionResponse, error) {
+	select {
+	case p.slots <- struct{}{}:
+	case <-ctx.Done():
+		return completionResponse{}, ctx.Err()
+	}
+	defer func() { <-p.slots }()
+	return stream(ctx, p.Provider, req, onDelta)
+}
+
+// Stream is not retried, a half-delivered reply cannot be taken back. Nor
+// is it cut after llm_attempt_timeout, a long reply streams for a while.
+func (p *resilientProvider) Stream(ctx context.Context, req completionRequest, onDelta func(string)) (completionResponse, error) {
+	if !p.breaker.allow(time.Now()) {
+		return completionResponse{}, errCircuitOpen
+	}
+	resp, err := stream(ctx, p.Provider, req, onDelta)
+	p.breaker.record(err, time.Now())
+	return resp, err
+}
+
+// throttle lets an action run at most once per interval.
+type throttle struct {
+	interval time.Duration
+	last     time.Time
+}
+
+func (t *throttle) allow(now time.Time) bool {
+	if now.Sub(t.last) < t.interval {
+		return false
+	}
+	t.last = now
+	return true
+}
@@ -0,0 +1,139 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+const openAIStream = `data: {"choices":[{"delta":{"role":"assistant"}}]}
+
+data: {"choices":[{"delta":{"content":"Во славу"}}]}
+
+data: {"choices":[{"delta":{"content":" Императора!"}}]}
+
+data: {"choices":[],"usage":{"prompt_tokens":12,"completion_tokens":5}}
+
+data: [DONE]
+
+`
+
+const anthropicStream = `event: message_start
+data: {"type":"message_start","message":{"usage":{"input_tokens":12,"output_tokens":1}}}
+
+event: content_block_start
+data: {"type":"content_block_start","index":0,"content_block":{"type":"text","text":""}}
+
+event: ping
+data: {"type":"ping"}
+
+event: content_block_delta
+data: {"type":"content_block_delta","index":0,"delta":{"type":"text_delta","text":"Во славу"}}
+
+event: content_block_delta
+data: {"type":"content_block_delta","index":0,"delta":{"type":"text_delta","text":" Императора!"}}
+
+event: content_block_stop
+data: {"type":"content_block_stop","index":0}
+
+event: message_delta
+data: {"type":"message_delta","delta":{"stop_reason":"end_turn"},"usage":{"output_tokens":5}}
+
+event: message_stop
+data: {"type":"message_stop"}
+
+`
+
+// cut returns the lines of stream before the first one containing marker,
+// as if the connection dropped there.
+func cut(stream, marker string) string {
+	return stream[:strings.LastIndex(stream[:strings.Index(stream, marker)], "\n")+1]
+}
+
+func TestStream(t *testing.T) {
+	tests := []struct {
+		name      string
+		anthropic bool
+		body      string
+		wantText  string
+		wantUsage tokenUsage
+		wantErr   error
+	}{
+		{
+			name:      "openai",
+			body:      openAIStream,
+			wantText:  "Во славу Императора!",
+			wantUsage: tokenUsage{PromptTokens: 12, CompletionTokens: 5},
+		},
+		{
+			name:     "openai cut",
+			body:     cut(openAIStream, "Императора"),
+			wantText: "Во славу",
+			wantErr:  errStreamCut,
+		},
+		{
+			name:    "openai error",
+			body:    "data: {\"error\":{\"message\":\"overloaded\"}}\n\n",
+			wantErr: errors.New("API error: overloaded"),
+		},
+		{
+			name:      "anthropic",
+			anthropic: true,
+			body:      anthropicStream,
+			wantText:  "Во славу Императора!",
+			wantUsage: tokenUsage{PromptTokens: 12, CompletionTokens: 5},
+		},
+		{
+			name:      "anthropic cut",
+			anthropic: true,
+			body:      cut(anthropicStream, "Императора"),
+			wantText:  "Во славу",
+			wantUsage: tokenUsage{PromptTokens: 12},
+			wantErr:   errStreamCut,
+		},
+		{
+			name:      "anthropic error",
+			anthropic: true,
+			body:      "event: error\ndata: {\"type\":\"error\",\"error\":{\"type\":\"overloaded_error\",\"message\":\"Overloaded\"}}\n\n",
+			wantErr:   errors.New("API error: Overloaded"),
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Set("Content-Type", "text/event-stream")
+				w.Write([]byte(tt.body))
+			}))
+			defer server.Close()
+
+			var p StreamingProvider = &openAIProvider{url: server.URL, client: server.Client()}
+			if tt.anthropic {
+				p = &anthropicProvider{url: server.URL, client: server.Client()}
+			}
+			var deltas strings.Builder
+			resp, err := p.Stream(context.Background(), completionRequest{
+				Messages: []promptMessage{{Role: "user", Content: "vasya: привет"}},
+			}, func(delta string) { deltas.WriteString(delta) })
+
+			switch {
+			case tt.wantErr == nil && err != nil:
+				t.Fatalf("Stream() error = %v", err)
+			case tt.wantErr != nil && (err == nil || err.Error() != tt.wantErr.Error()):
+				t.Fatalf("Stream() error = %v, want %v", err, tt.wantErr)
+			}
+			if resp.Text != tt.wantText {
+				t.Errorf("Stream() text = %q, want %q", resp.Text, tt.wantText)
+			}
+			if got := strings.TrimSpace(deltas.String()); got != tt.wantText {
+				t.Errorf("deltas = %q, want %q", got, tt.wantText)
+			}
+			if resp.Usage != tt.wantUsage {
+				t.Errorf("Stream() usage = %+v, want %+v", resp.Usage, tt.wantUsage)
+			}
+		})
+	}
+}
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"mime/multipart"
+	"net/http"
+	"strings"
+	"time"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+)
+
+// Transcriber turns speech into text.
+type Transcriber interface {
+	Transcribe(ctx context.Context, audio []byte, fileName string) (string, error)
+}
+
+// newTranscriber returns the configured speech-to-text backend, or nil when
+// voice messages are not transcribed.
+func newTranscriber(config *Config) Transcriber {
+	if config.STTURL == "" {
+		return nil
+	}
+	return &whisperTranscriber{
+		url:      config.STTURL,
+		apiKey:   config.STTAPIKey,
+		model:    config.STTModel,
+		language: config.STTLanguage,
+		client:   &http.Client{Timeout: 60 * time.Second},
+	}
+}
+
+// whisperTranscriber talks to an OpenAI-compatible /audio/transcriptions
+// endpoint, which whisper.cpp's server provides as well.
+type whisperTranscriber struct {
+	url      string
+	apiKey   string
+	model    string
+	language string
+	client   *http.Client
+}
+
+func (t *whisperTranscriber) Transcribe(ctx context.Context, audio []byte, fileName string) (string, error) {
+	var body bytes.Buffer
+	form := multipart.NewWriter(&body)
+	file, err := form.CreateFormFile("file", fileName)
+	if err != nil {
+		return "", err
+	}
+	file.Write(audio)
+	form.WriteField("model", t.model)
+	form.WriteField("response_format", "json")
+	if t.language != "" {
+		form.WriteField("language", t.language)
+	}
+	if err := form.Close(); err != nil {
+		return "", err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, "POST", t.url, &body)
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Content-Type", form.FormDataContentType())
+	if t.apiKey != "" {
+		req.Header.Set("Authorization", "Bearer "+t.apiKey)
+	}
+
+	resp, err := t.client.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return "", newAPIError(resp)
+	}
+
+	var result struct {
+		Text string `json:"text"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return "", fmt.Errorf("unable to decode response: %v", err)
+	}
+	return strings.TrimSpace(result.Text), nil
+}
+
+// transcribeVoice replaces the empty text of a voice message with its
+// transcript. Voice messages over the configured limits stay untranscribed.
+func transcribeVoice(stt Transcriber, bot Sender, message *tgbotapi.Message, config *Config) {
+	voice := message.Voice
+	if voice.FileSize > config.MaxVoiceBytes ||
+		time.Duration(voice.Duration)*time.Second > config.MaxVoiceDuration {
+		log.Printf("Voice message %d in chat %d is too long to transcribe", message.MessageID, message.Chat.ID)
+		return
+	}
+
+	audio, err := downloadFile(bot, voice.FileID, config.MaxVoiceBytes)
+	if err != nil {
+		log.Printf("Error downloading voice message: %v", err)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), config.LLMTimeout)
+	defer cancel()
+	text, err := stt.Transcribe(ctx, audio, "voice.ogg")
+	if err != nil {
+		log.Printf("Error transcribing voice message: %v", err)
+		return
+	}
+	message.Text = text
+}
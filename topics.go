@@ -0,0 +1,48 @@
+package main
+
+import (
+	"encoding/json"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+)
+
+// The vendored tgbotapi predates forum topics, so requests into a topic are
+// assembled here with message_thread_id. Outside topics the library's own
+// configs are used.
+
+// sendToThread sends msg into forum topic threadID, or to the chat itself
+// when threadID is 0.
+func sendToThread(bot Sender, msg tgbotapi.MessageConfig, threadID int) (tgbotapi.Message, error) {
+	if threadID == 0 {
+		return bot.Send(msg)
+	}
+
+	params := tgbotapi.Params{}
+	params.AddNonZero64("chat_id", msg.ChatID)
+	params.AddNonZero("message_thread_id", threadID)
+	params.AddNonEmpty("text", msg.Text)
+	params.AddNonZero("reply_to_message_id", msg.ReplyToMessageID)
+
+	resp, err := bot.MakeRequest("sendMessage", params)
+	if err != nil {
+		return tgbotapi.Message{}, err
+	}
+	var sent tgbotapi.Message
+	err = json.Unmarshal(resp.Result, &sent)
+	return sent, err
+}
+
+// sendChatAction shows action in the conversation of key.
+func sendChatAction(bot Sender, key chatKey, action string) error {
+	if key.ThreadID == 0 {
+		_, err := bot.Request(tgbotapi.NewChatAction(key.ChatID, action))
+		return err
+	}
+
+	params := tgbotapi.Params{}
+	params.AddNonZero64("chat_id", key.ChatID)
+	params.AddNonZero("message_thread_id", key.ThreadID)
+	params.AddNonEmpty("action", action)
+	_, err := bot.MakeRequest("sendChatAction", params)
+	return err
+}
@@ -0,0 +1,267 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+	// Quiet hours need time zones even on hosts without zoneinfo.
+	_ "time/tzdata"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+)
+
+const (
+	triggerMention = "mention"
+	triggerReply   = "reply"
+	triggerKeyword = "keyword"
+	triggerRandom  = "random"
+	triggerCommand = "command"
+	// triggerVoice is a voice message waiting for its transcript, the
+	// trigger rules run once it is there.
+	triggerVoice = "voice"
+)
+
+// triggerRule answers unsolicited when a message contains one of Keywords or
+// matches Pattern.
+type triggerRule struct {
+	Name        string   `mapstructure:"name"`
+	Keywords    []string `mapstructure:"keywords"`
+	Pattern     string   `mapstructure:"pattern"`
+	Probability *float64 `mapstructure:"probability"`
+}
+
+type compiledRule struct {
+	triggerRule
+	keywords []string
+	re       *regexp.Regexp
+}
+
+func (r *compiledRule) match(text string) bool {
+	lower := strings.ToLower(text)
+	for _, k := range r.keywords {
+		if strings.Contains(lower, k) {
+			return true
+		}
+	}
+	return r.re != nil && r.re.MatchString(text)
+}
+
+func (r *compiledRule) probability() float64 {
+	if r.Probability != nil {
+		return *r.Probability
+	}
+	return 1
+}
+
+// triggerEngine holds the validated trigger settings of a config.
+type triggerEngine struct {
+	rules []compiledRule
+	quiet quietHours
+	loc   *time.Location
+}
+
+func newTriggerEngine(config *Config) (*triggerEngine, error) {
+	e := &triggerEngine{}
+	for i, rule := range config.Triggers {
+		if rule.Name == "" {
+			return nil, fmt.Errorf("triggers[%d]: name is required", i)
+		}
+		if len(rule.Keywords) == 0 && rule.Pattern == "" {
+			return nil, fmt.Errorf("trigger %s: keywords or pattern is required", rule.Name)
+		}
+		if p := rule.Probability; p != nil && (*p < 0 || *p > 1) {
+			return nil, fmt.Errorf("trigger %s: probability must be between 0 and 1", rule.Name)
+		}
+		c := compiledRule{triggerRule: rule}
+		for _, k := range rule.Keywords {
+			c.keywords = append(c.keywords, strings.ToLower(k))
+		}
+		if rule.Pattern != "" {
+			re, err := regexp.Compile(rule.Pattern)
+			if err != nil {
+				return nil, fmt.Errorf("trigger %s: %v", rule.Name, err)
+			}
+			c.re = re
+		}
+		e.rules = append(e.rules, c)
+	}
+
+	for user, w := range config.UserWeights {
+		if w < 0 {
+			return nil, fmt.Errorf("user_weights.%s must not be negative", user)
+		}
+	}
+	if config.MinMessageGap < 0 {
+		return nil, fmt.Errorf("min_message_gap must not be negative")
+	}
+
+	var err error
+	if e.quiet, err = parseQuietHours(config.QuietHours); err != nil {
+		return nil, fmt.Errorf("quiet_hours: %v", err)
+	}
+	if e.loc, err = time.LoadLocation(config.TimeZone); err != nil {
+		return nil, fmt.Errorf("time_zone: %v", err)
+	}
+	return e, nil
+}
+
+// quietHours is a daily window in minutes after midnight. The window may
+// wrap around midnight; a zero window is never quiet.
+type quietHours struct {
+	from, to int
+}
+
+// parseQuietHours reads a window like "23:00-08:00". An empty string or
+// "off" disables quiet hours.
+func parseQuietHours(s string) (quietHours, error) {
+	if s == "" || s == "off" {
+		return quietHours{}, nil
+	}
+	from, to, ok := strings.Cut(s, "-")
+	if !ok {
+		return quietHours{}, fmt.Errorf("expected HH:MM-HH:MM, got %q", s)
+	}
+	f, err := time.Parse("15:04", strings.TrimSpace(from))
+	if err != nil {
+		return quietHours{}, fmt.Errorf("expected HH:MM-HH:MM, got %q", s)
+	}
+	t, err := time.Parse("15:04", strings.TrimSpace(to))
+	if err != nil {
+		return quietHours{}, fmt.Errorf("expected HH:MM-HH:MM, got %q", s)
+	}
+	return quietHours{from: f.Hour()*60 + f.Minute(), to: t.Hour()*60 + t.Minute()}, nil
+}
+
+func (q quietHours) contains(t time.Time) bool {
+	m := t.Hour()*60 + t.Minute()
+	if q.from <= q.to {
+		return m >= q.from && m < q.to
+	}
+	return m >= q.from || m < q.to
+}
+
+func (q quietHours) String() string {
+	if q.from == q.to {
+		return "off"
+	}
+	return fmt.Sprintf("%02d:%02d-%02d:%02d", q.from/60, q.from%60, q.to/60, q.to%60)
+}
+
+// quietHours returns the chat's quiet window and time zone, falling back to
+// the configured ones.
+func (s chatSettings) quietHours(config *Config) (quietHours, *time.Location) {
+	quiet, loc := config.Trigger.quiet, config.Trigger.loc
+	if s.QuietHours != "" {
+		if q, err := parseQuietHours(s.QuietHours); err == nil {
+			quiet = q
+		}
+	}
+	if s.TimeZone != "" {
+		if l, err := time.LoadLocation(s.TimeZone); err == nil {
+			loc = l
+		}
+	}
+	return quiet, loc
+}
+
+// userWeight scales unsolicited triggers for the author of a message. Weights
+// are looked up by user name and then by user ID.
+func userWeight(config *Config, from *tgbotapi.User) float64 {
+	if from == nil {
+		return 1
+	}
+	// viper lowercases map keys.
+	if w, ok := config.UserWeights[strings.ToLower(from.UserName)]; ok && from.UserName != "" {
+		return w
+	}
+	if w, ok := config.UserWeights[strconv.FormatInt(from.ID, 10)]; ok {
+		return w
+	}
+	return 1
+}
+
+// triggerReason tells why the bot should answer message, or returns an
+// empty reason when it should stay silent. detail describes the rule that
+// fired, or the one that held back an unsolicited reply, for the logs.
+func triggerReason(bot Sender, message *tgbotapi.Message, config *Config,
+	settings chatSettings, activity chatActivity, now time.Time, rng Random) (reason, detail string) {
+	text := messageText(message)
+	if !hasContent(message, config) || settings.muted(now) {
+		return "", ""
+	}
+
+	if strings.Contains(strings.ToLower(text), "@"+strings.ToLower(bot.Me().UserName)) {
+		return triggerMention, "mention of the bot"
+	}
+
+	if message.ReplyToMessage != nil &&
+		message.ReplyToMessage.From != nil &&
+		message.ReplyToMessage.From.ID == bot.Me().ID {
+		return triggerReply, "reply to the bot"
+	}
+
+	// Everything below is unsolicited.
+	weight := userWeight(config, message.From)
+	reason, detail = unsolicitedReason(text, config, settings, activity, weight, rng)
+	if reason == "" {
+		return "", ""
+	}
+
+	if config.ReplyCooldown > 0 && now.Sub(activity.LastReply) < config.ReplyCooldown {
+		return "", fmt.Sprintf("%s held back: cooldown, last reply %s ago",
+			detail, now.Sub(activity.LastReply).Round(time.Second))
+	}
+	if config.MinMessageGap > 0 && !activity.LastReply.IsZero() && activity.SinceReply < config.MinMessageGap {
+		return "", fmt.Sprintf("%s held back: %d of %d messages since last reply",
+			detail, activity.SinceReply, config.MinMessageGap)
+	}
+	quiet, loc := settings.quietHours(config)
+	if local := now.In(loc); quiet.contains(local) {
+		return "", fmt.Sprintf("%s held back: quiet hours %s, %s %s",
+			detail, quiet, local.Format("15:04"), loc)
+	}
+	return reason, detail
+}
+
+// decideTrigger runs the trigger rules for a recorded message and checks
+// the token budget for everything but mentions. It logs the outcome and returns
+// the reason to answer, or an empty reason, with the detail for the logs.
+func decideTrigger(bot Sender, message *tgbotapi.Message, config *Config, chats *chatStates, key chatKey,
+	now time.Time, rng Random) (reason, detail string) {
+	reason, detail = triggerReason(bot, message, config, chats.settings(key),
+		chats.activity(key, now, config.AdaptiveWindow), now, rng)
+	if reason == triggerRandom || reason == triggerKeyword || reason == triggerReply {
+		if config.budgetLevel(chats.globalUsage(now)) != budgetOK {
+			reason, detail = "", detail+" held back: token budget used up"
+		}
+	}
+	if reason == "" {
+		if detail != "" {
+			log.Printf("Not answering message %d in chat %d: %s", message.MessageID, key.ChatID, detail)
+		}
+		return "", detail
+	}
+	log.Printf("Answering message %d in chat %d: %s", message.MessageID, key.ChatID, detail)
+	return reason, detail
+}
+
+// unsolicitedReason checks the trigger rules and then the random roll.
+// Persona keywords do not trigger, they only pick who answers.
+func unsolicitedReason(text string, config *Config, settings chatSettings, activity chatActivity,
+	weight float64, rng Random) (reason, detail string) {
+	for i := range config.Trigger.rules {
+		rule := &config.Trigger.rules[i]
+		if rule.match(text) && rng.Float64() < rule.probability()*weight {
+			return triggerKeyword, "rule " + rule.Name
+		}
+	}
+
+	p := settings.probability(config, activity) * weight
+	if rng.Float64() < p {
+		return triggerRandom, fmt.Sprintf("random roll under %.2f", p)
+	}
+	return "", ""
+}
@@ -0,0 +1,45 @@
+package main
+
+import "testing"
+
+// fixedRandom rolls the same number every time.
+type fixedRandom float64
+
+func (r fixedRandom) Float64() float64 { return float64(r) }
+
+func TestUnsolicitedReason(t *testing.T) {
+	half := 0.5
+	config := &Config{
+		TriggerProbability: 0.1,
+		Triggers:           []triggerRule{{Name: "heresy", Keywords: []string{"ересь"}, Probability: &half}},
+		Personas: &personaRegistry{
+			personas: []*Persona{{ID: "inquisitor", Keywords: []string{"ересь"}, Weight: 1}},
+			byID:     map[string]*Persona{},
+		},
+	}
+	engine, err := newTriggerEngine(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	config.Trigger = engine
+
+	tests := []struct {
+		name       string
+		text       string
+		roll       float64
+		wantReason string
+	}{
+		{"rule fires", "Это ересь!", 0.4, triggerKeyword},
+		{"rule roll fails", "Это ересь!", 0.7, ""},
+		{"random roll", "Кто играет сегодня?", 0.05, triggerRandom},
+		{"nothing", "Кто играет сегодня?", 0.7, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			reason, detail := unsolicitedReason(tt.text, config, chatSettings{}, chatActivity{}, 1, fixedRandom(tt.roll))
+			if reason != tt.wantReason {
+				t.Errorf("unsolicitedReason(%q) = %q (%s), want %q", tt.text, reason, detail, tt.wantReason)
+			}
+		})
+	}
+}
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"log"
+	"sync"
+	"time"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+)
+
+// Telegram shows a chat action for five seconds, so it is refreshed a
+// little more often than that.
+const typingInterval = 4 * time.Second
+
+// typingIndicator keeps "typing…" visible in a chat while a reply is being
+// generated.
+type typingIndicator struct {
+	done    chan struct{}
+	stopped chan struct{}
+	once    sync.Once
+}
+
+func keepTyping(bot Sender, key chatKey) *typingIndicator {
+	t := &typingIndicator{
+		done:    make(chan struct{}),
+		stopped: make(chan struct{}),
+	}
+
+	go func() {
+		defer close(t.stopped)
+
+		ticker := time.NewTicker(typingInterval)
+		defer ticker.Stop()
+		for {
+			if err := sendChatAction(bot, key, tgbotapi.ChatTyping); err != nil {
+				log.Printf("Error sending chat action: %v", err)
+				metricSendErrors.inc("sendChatAction")
+			}
+			select {
+			case <-t.done:
+				return
+			case <-ticker.C:
+			}
+		}
+	}()
+
+	return t
+}
+
+// stop ends the indicator and waits until no chat action is in flight, so
+// none arrives after the reply. It is safe to call more than once.
+func (t *typingIndicator) stop() {
+	t.once.Do(func() { close(t.done) })
+	<-t.stopped
+}
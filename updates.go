@@ -0,0 +1,117 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"time"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+)
+
+// topicInfo holds the forum topic fields of a message. The vendored
+// tgbotapi version predates forum topics and does not decode them.
+type topicInfo struct {
+	MessageThreadID int  `json:"message_thread_id"`
+	IsTopicMessage  bool `json:"is_topic_message"`
+}
+
+// incomingUpdate is a tgbotapi.Update together with the topic information
+// of its message.
+type incomingUpdate struct {
+	tgbotapi.Update
+	Topic topicInfo
+}
+
+func decodeUpdate(data []byte) (incomingUpdate, error) {
+	var u incomingUpdate
+	if err := json.Unmarshal(data, &u.Update); err != nil {
+		return u, err
+	}
+
+	var raw struct {
+		Message *topicInfo `json:"message"`
+	}
+	if err := json.Unmarshal(data, &raw); err != nil {
+		return u, err
+	}
+	if raw.Message != nil {
+		u.Topic = *raw.Message
+	}
+	// In a forum topic every message that is not a reply points at the
+	// service message that created the topic.
+	if m := u.Message; m != nil && u.Topic.IsTopicMessage &&
+		m.ReplyToMessage != nil && m.ReplyToMessage.MessageID == u.Topic.MessageThreadID {
+		m.ReplyToMessage = nil
+	}
+	return u, nil
+}
+
+// pollUpdates works like bot.GetUpdatesChan but keeps the topic fields
+// of every update. It closes the channel once ctx is done.
+func pollUpdates(ctx context.Context, bot *tgbotapi.BotAPI, config tgbotapi.UpdateConfig) <-chan incomingUpdate {
+	ch := make(chan incomingUpdate, bot.Buffer)
+
+	go func() {
+		defer close(ch)
+		for ctx.Err() == nil {
+			resp, err := bot.Request(config)
+			if err != nil {
+				if ctx.Err() != nil {
+					return
+				}
+				log.Println(err)
+				log.Println("Failed to get updates, retrying in 3 seconds...")
+				sleep(ctx, time.Second*3)
+
+				continue
+			}
+
+			var raw []json.RawMessage
+			if err := json.Unmarshal(resp.Result, &raw); err != nil {
+				log.Printf("Failed to decode updates: %v", err)
+				log.Println("Retrying in 3 seconds...")
+				sleep(ctx, time.Second*3)
+
+				continue
+			}
+
+			for _, r := range raw {
+				// The offset moves past an update even when it cannot be
+				// decoded, or getUpdates would return it again at once.
+				var id struct {
+					UpdateID int `json:"update_id"`
+				}
+				if err := json.Unmarshal(r, &id); err != nil {
+					log.Printf("Failed to decode update: %v", err)
+					continue
+				}
+				if id.UpdateID < config.Offset {
+					continue
+				}
+				config.Offset = id.UpdateID + 1
+
+				update, err := decodeUpdate(r)
+				if err != nil {
+					log.Printf("Failed to decode update %d: %v", id.UpdateID, err)
+					continue
+				}
+				select {
+				case ch <- update:
+				case <-ctx.Done():
+					return
+				}
+			}
+		}
+	}()
+
+	return ch
+}
+
+// sleep waits for d or until ctx is done.
+func sleep(ctx context.Context, d time.Duration) {
+	select {
+	case <-time.After(d):
+	case <-ctx.Done():
+	}
+}
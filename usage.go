@@ -0,0 +1,99 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// usageRetentionDays is how long daily token usage is kept, enough to
+// cover the current and the previous month.
+const usageRetentionDays = 62
+
+func usageDay(t time.Time) string {
+	return t.UTC().Format("2006-01-02")
+}
+
+// sumUsage returns the usage for the day of now and for its month.
+func sumUsage(days map[string]tokenUsage, now time.Time) (day, month tokenUsage) {
+	today := usageDay(now)
+	thisMonth := today[:7]
+	for d, u := range days {
+		if d == today {
+			day = day.add(u)
+		}
+		if strings.HasPrefix(d, thisMonth) {
+			month = month.add(u)
+		}
+	}
+	return day, month
+}
+
+// expireUsage drops days past the retention.
+func expireUsage(days map[string]tokenUsage, now time.Time) {
+	cutoff := usageDay(now.AddDate(0, 0, -usageRetentionDays))
+	for d := range days {
+		if d < cutoff {
+			delete(days, d)
+		}
+	}
+}
+
+type budgetLevel int
+
+const (
+	budgetOK budgetLevel = iota
+	// budgetSoft: only mentions are answered.
+	budgetSoft
+	// budgetHard: everything is answered with fallback lines.
+	budgetHard
+)
+
+func over(used, limit int) bool {
+	return limit > 0 && used >= limit
+}
+
+// budgetLevel tells which of the configured budgets the global usage hit.
+func (c *Config) budgetLevel(day, month tokenUsage) budgetLevel {
+	switch {
+	case over(day.total(), c.HardDailyTokens) || over(month.total(), c.HardMonthlyTokens):
+		return budgetHard
+	case over(day.total(), c.SoftDailyTokens) || over(month.total(), c.SoftMonthlyTokens):
+		return budgetSoft
+	default:
+		return budgetOK
+	}
+}
+
+var errBudgetExceeded = errors.New("token budget exceeded")
+
+// budgetProvider refuses calls once the hard budget is used up, so replies
+// fall back to in-character lines.
+type budgetProvider struct {
+	Provider
+	exceeded func() bool
+}
+
+func (p *budgetProvider) Generate(ctx context.Context, req completionRequest) (completionResponse, error) {
+	if p.exceeded() {
+		return completionResponse{}, errBudgetExceeded
+	}
+	return p.Provider.Generate(ctx, req)
+}
+
+func (p *budgetProvider) Stream(ctx context.Context, req completionRequest, onDelta func(string)) (completionResponse, error) {
+	if p.exceeded() {
+		return completionResponse{}, errBudgetExceeded
+	}
+	return stream(ctx, p.Provider, req, onDelta)
+}
+
+func formatUsage(u tokenUsage, limit int) string {
+	s := fmt.Sprintf("%d (%d вход, %d выход)", u.total(), u.PromptTokens, u.CompletionTokens)
+	if limit > 0 {
+		s += fmt.Sprintf(" из %d", limit)
+	}
+	return s
+}